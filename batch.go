@@ -0,0 +1,218 @@
+package gophermail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+var ErrBatchSenderClosed = errors.New("The batch sender is closed.")
+
+// batchConnectTimeout limits how long a BatchSender can take to connect
+// and start a session.
+var batchConnectTimeout = 30 * time.Second
+
+// A BatchSender sends any number of messages over a single SMTP
+// connection, so that connecting, STARTTLS and AUTH only happen once,
+// instead of once per message like with SendMail.
+//
+// A BatchSender is not safe for concurrent use.
+type BatchSender struct {
+	addr   string
+	auth   smtp.Auth
+	tlsCfg *tls.Config
+	opts   *sendOptions
+
+	c      *smtp.Client
+	tls    *tls.ConnectionState
+	closed bool
+}
+
+// NewBatchSender connects to the server at addr, switches to TLS if possible
+// and authenticates with auth if possible.
+// auth and tlsCfg are optional, like for NewSMTPSender.
+// The BatchSender must be closed when done.
+func NewBatchSender(addr string, auth smtp.Auth, tlsCfg *tls.Config, opts ...SendOption) (*BatchSender, error) {
+	b := &BatchSender{
+		addr:   addr,
+		auth:   auth,
+		tlsCfg: tlsCfg,
+		opts:   newSendOptions(opts),
+	}
+
+	err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// connect dials the server and starts a new session.
+func (b *BatchSender) connect() error {
+	addr := b.opts.resolveAddr(b.addr)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	cfg := b.tlsCfg
+	if cfg == nil {
+		cfg = &tls.Config{ServerName: host}
+	}
+
+	d := &net.Dialer{Timeout: batchConnectTimeout}
+	conn, err := b.opts.dialContext(context.Background(), d, addr)
+	if err != nil {
+		return err
+	}
+
+	// The deadline also covers the greeting, STARTTLS and AUTH,
+	// so that a server that accepts the connection but never
+	// responds can't block forever either.
+	err = conn.SetDeadline(time.Now().Add(batchConnectTimeout))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	if b.opts.implicitTLS {
+		conn = tls.Client(conn, cfg)
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	result, err := startSession(c, b.auth, cfg, b.opts)
+	if err != nil {
+		c.Close()
+		return err
+	}
+
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		c.Close()
+		return err
+	}
+
+	b.c = c
+	b.tls = result.TLS
+	return nil
+}
+
+// Send sends a message over the connection.
+//
+// If the connection turns out to be broken, e.g. because the server
+// closed it after a timeout, Send reconnects and retries once.
+// A message with streamed attachments isn't retried once DATA has
+// started, since they can't be read again; Send returns the
+// connection error instead.
+// If the server rejects the message, the transaction is reset
+// so that the next message can be sent.
+func (b *BatchSender) Send(msg *Message) error {
+	_, err := b.send(msg)
+	return err
+}
+
+// SendBatch sends messages over the connection like Send, and returns
+// the outcome of each, in the same order. It doesn't stop at failures.
+func (b *BatchSender) SendBatch(msgs []*Message) []SendResult {
+	results := make([]SendResult, len(msgs))
+	for i, msg := range msgs {
+		queueID, err := b.send(msg)
+		results[i] = SendResult{
+			Index:   i,
+			Success: err == nil,
+			QueueID: queueID,
+			Err:     err,
+			TLS:     b.tls,
+		}
+	}
+	return results
+}
+
+// send implements Send and returns the queue id of the message.
+func (b *BatchSender) send(msg *Message) (string, error) {
+	if b.closed {
+		return "", ErrBatchSenderClosed
+	}
+
+	msgData, size, err := messageData(msg)
+	if err != nil {
+		return "", err
+	}
+
+	from, to := envelope(msg)
+
+	if b.c != nil {
+		queueID, err := transmit(b.c, from, to, msgData, size, b.opts)
+		if err == nil {
+			return queueID, nil
+		}
+		if !isConnectionError(err) {
+			b.c.Reset()
+			return "", err
+		}
+		b.c.Close()
+		b.c = nil
+		if e, ok := msgData.(*encodedMessage); ok && e.written {
+			// The message was cut off in the middle of DATA,
+			// and its attachments can't be read again to retry.
+			return "", unwrapAttachmentError(err)
+		}
+	}
+
+	err = b.connect()
+	if err != nil {
+		return "", err
+	}
+
+	queueID, err := transmit(b.c, from, to, msgData, size, b.opts)
+	if err != nil {
+		if isConnectionError(err) {
+			b.c.Close()
+			b.c = nil
+		} else {
+			b.c.Reset()
+		}
+	}
+	return queueID, unwrapAttachmentError(err)
+}
+
+// Close sends QUIT and closes the connection.
+func (b *BatchSender) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	if b.c == nil {
+		return nil
+	}
+
+	err := b.c.Quit()
+	if err != nil {
+		b.c.Close()
+	}
+	b.c = nil
+	return err
+}
+
+// isConnectionError reports whether err means that the connection
+// can't be used anymore, as opposed to the server rejecting a command.
+// That includes attachmentErrors, which cut the message off in the
+// middle of DATA.
+func isConnectionError(err error) bool {
+	protocolErr, ok := err.(*textproto.Error)
+	if !ok {
+		return true
+	}
+
+	// 421: Service not available, closing transmission channel.
+	return protocolErr.Code == 421
+}
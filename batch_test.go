@@ -0,0 +1,208 @@
+package gophermail
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestBatchSender(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t)
+
+	b, err := NewBatchSender(server.Addr(), nil, nil)
+	expectNoError(err)
+
+	for i := 0; i < 3; i++ {
+		expectNoError(b.Send(testSendMessage()))
+	}
+	expectNoError(b.Close())
+
+	Expect(server.Messages()).To(HaveLen(3))
+	Expect(server.Count("EHLO")).To(Equal(1), "connected more than once")
+	Expect(server.Count("MAIL")).To(Equal(3))
+	Expect(server.Count("QUIT")).To(Equal(1))
+
+	Expect(b.Send(testSendMessage())).To(Equal(ErrBatchSenderClosed))
+}
+
+func TestBatchSenderRejected(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t)
+	server.reply = func(cmd string) string {
+		if strings.Contains(cmd, "rejected@domain.com") {
+			return "550 No such user"
+		}
+		return ""
+	}
+
+	b, err := NewBatchSender(server.Addr(), nil, nil)
+	expectNoError(err)
+	defer b.Close()
+
+	rejected := testSendMessage()
+	rejected.To = nil
+	expectNoError(rejected.AddTo("rejected@domain.com"))
+
+	Expect(b.Send(rejected)).NotTo(BeNil(), "rejected recipient not reported")
+	expectNoError(b.Send(testSendMessage()))
+
+	Expect(server.Count("RSET")).To(Equal(1), "transaction not reset after rejection")
+	Expect(server.Messages()).To(HaveLen(1))
+	Expect(server.Count("EHLO")).To(Equal(1), "reconnected after a rejection")
+}
+
+func TestBatchSenderReconnect(t *testing.T) {
+	registerFailHandler(t)
+
+	var mu sync.Mutex
+	mails := 0
+
+	server := newFakeSMTPServer(t)
+	// Drop the connection at the start of the second message.
+	server.drop = func(cmd string) bool {
+		if !strings.HasPrefix(cmd, "MAIL") {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		mails++
+		return mails == 2
+	}
+
+	b, err := NewBatchSender(server.Addr(), nil, nil)
+	expectNoError(err)
+
+	expectNoError(b.Send(testSendMessage()))
+	expectNoError(b.Send(testSendMessage()))
+	expectNoError(b.Close())
+
+	Expect(server.Messages()).To(HaveLen(2))
+	Expect(server.Count("EHLO")).To(Equal(2), "did not reconnect")
+}
+
+func TestBatchSenderSendBatch(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t)
+	server.reply = func(cmd string) string {
+		if strings.Contains(cmd, "rejected@domain.com") {
+			return "550 No such user"
+		}
+		return ""
+	}
+
+	b, err := NewBatchSender(server.Addr(), nil, nil)
+	expectNoError(err)
+	defer b.Close()
+
+	rejected := testSendMessage()
+	rejected.To = nil
+	expectNoError(rejected.AddTo("rejected@domain.com"))
+
+	results := b.SendBatch([]*Message{testSendMessage(), rejected, testSendMessage()})
+	Expect(results).To(HaveLen(3))
+
+	for i, result := range results {
+		Expect(result.Index).To(Equal(i))
+	}
+
+	Expect(results[0].Success).To(BeTrue())
+	Expect(results[0].Err).To(BeNil())
+	Expect(results[0].QueueID).To(Equal("Q1"))
+
+	Expect(results[1].Success).To(BeFalse())
+	Expect(results[1].Err).NotTo(BeNil())
+	Expect(results[1].Err.Error()).To(ContainSubstring("No such user"))
+	Expect(results[1].QueueID).To(BeEmpty())
+
+	Expect(results[2].Success).To(BeTrue())
+	Expect(results[2].QueueID).To(Equal("Q2"))
+}
+
+func TestBatchSenderConnectTimeout(t *testing.T) {
+	registerFailHandler(t)
+
+	defer func(timeout time.Duration) {
+		batchConnectTimeout = timeout
+	}(batchConnectTimeout)
+	batchConnectTimeout = 100 * time.Millisecond
+
+	// The listener accepts connections, but nothing ever greets them.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	expectNoError(err)
+	defer l.Close()
+
+	start := time.Now()
+	_, err = NewBatchSender(l.Addr().String(), nil, nil)
+	Expect(err).NotTo(BeNil(), "connected to a server that never greets")
+	netErr, ok := err.(net.Error)
+	Expect(ok && netErr.Timeout()).To(BeTrue(), "unexpected error: %v", err)
+	Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second), "connect did not time out")
+}
+
+func TestBatchSenderAttachmentError(t *testing.T) {
+	registerFailHandler(t)
+
+	readErr := errors.New("disk read failed")
+	newMessage := func() *Message {
+		m := testSendMessage()
+		m.Attachments = []Attachment{{
+			Name: "test.txt",
+			Data: io.MultiReader(strings.NewReader(strings.Repeat("Test attachment\n", 100)), iotest.ErrReader(readErr)),
+		}}
+		return m
+	}
+
+	server := newFakeSMTPServer(t)
+
+	b, err := NewBatchSender(server.Addr(), nil, nil)
+	expectNoError(err)
+
+	Expect(b.Send(newMessage())).To(Equal(readErr))
+	Expect(server.Count("EHLO")).To(Equal(1), "retried after an attachment error")
+	Expect(server.Messages()).To(BeEmpty(), "partial message accepted")
+
+	// The cut off connection is replaced.
+	expectNoError(b.Send(testSendMessage()))
+	expectNoError(b.Close())
+	Expect(server.Count("EHLO")).To(Equal(2))
+	Expect(server.Messages()).To(HaveLen(1))
+
+	Expect(SendMail(server.Addr(), nil, newMessage())).To(Equal(readErr))
+	_, err = newMessage().Bytes()
+	Expect(err).To(Equal(readErr))
+}
+
+func TestBatchSenderDroppedDuringData(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t)
+	server.dropData = true
+
+	b, err := NewBatchSender(server.Addr(), nil, nil)
+	expectNoError(err)
+
+	m := testSendMessage()
+	m.Attachments = []Attachment{{
+		Name: "test.txt",
+		Data: strings.NewReader(strings.Repeat("Test attachment\n", 100)),
+	}}
+
+	err = b.Send(m)
+	Expect(err).To(HaveOccurred())
+	Expect(err).NotTo(Equal(ErrAttachmentStreamed))
+	Expect(isConnectionError(err)).To(BeTrue(), "not a connection error: %v", err)
+	Expect(server.Count("EHLO")).To(Equal(1), "retried a streamed message")
+	Expect(server.Count("MAIL")).To(Equal(1), "started another transaction")
+	Expect(server.Messages()).To(BeEmpty())
+}
@@ -0,0 +1,308 @@
+package gophermail
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// defaultCharset is used when Message.Charset isn't set.
+const defaultCharset = "utf-8"
+
+// A charset is the character set of a message's text parts
+// and encoded-words.
+type charset struct {
+	// name is the value of the charset parameter.
+	name string
+
+	// encoding transcodes from UTF-8. It is nil for UTF-8 itself.
+	encoding encoding.Encoding
+}
+
+// charset looks up the message's Charset.
+func (m *Message) charset() (*charset, error) {
+	return lookupCharset(m.Charset)
+}
+
+// lookupCharset looks up a charset by its MIME name or an alias,
+// e.g. "latin2" for ISO-8859-2. An empty name means UTF-8.
+func lookupCharset(name string) (*charset, error) {
+	// "utf8" is a common misspelling that ianaindex doesn't know.
+	if name == "" || strings.EqualFold(name, defaultCharset) || strings.EqualFold(name, "utf8") {
+		return &charset{name: defaultCharset}, nil
+	}
+
+	enc, err := ianaindex.MIME.Encoding(name)
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("Unknown charset %q.", name)
+	}
+	if enc == unicode.UTF8 {
+		return &charset{name: defaultCharset}, nil
+	}
+
+	mimeName, err := ianaindex.MIME.Name(enc)
+	if err != nil {
+		mimeName = name
+	}
+	return &charset{name: mimeName, encoding: enc}, nil
+}
+
+// charsetReader returns a reader that transcodes r from the named
+// charset to UTF-8. It is the CharsetReader of the mime.WordDecoder
+// used by ReadMessage.
+func charsetReader(name string, r io.Reader) (io.Reader, error) {
+	cs, err := lookupCharset(name)
+	if err != nil {
+		return nil, err
+	}
+	if cs.isUTF8() {
+		return r, nil
+	}
+	return cs.encoding.NewDecoder().Reader(r), nil
+}
+
+// isUTF8 reports whether the charset is UTF-8.
+func (c *charset) isUTF8() bool {
+	return c.encoding == nil
+}
+
+// encode transcodes s from UTF-8 to the charset.
+// It returns an error identifying the first rune
+// that the charset can't represent.
+func (c *charset) encode(s string) (string, error) {
+	if c.isUTF8() {
+		return s, nil
+	}
+
+	encoded, err := c.encoding.NewEncoder().String(s)
+	if err == nil {
+		return encoded, nil
+	}
+
+	// Find the culprit to give a useful error.
+	for i, r := range s {
+		if r == utf8.RuneError {
+			return "", fmt.Errorf("Invalid UTF-8 at byte %d.", i)
+		}
+		_, err := c.encoding.NewEncoder().String(string(r))
+		if err != nil {
+			return "", fmt.Errorf("Character %q (%U) at byte %d can't be represented in charset %s.", r, r, i, c.name)
+		}
+	}
+	return "", err
+}
+
+// decode transcodes b from the charset to UTF-8.
+func (c *charset) decode(b []byte) (string, error) {
+	if c.isUTF8() {
+		return string(b), nil
+	}
+
+	decoded, err := c.encoding.NewDecoder().Bytes(b)
+	if err != nil {
+		return "", fmt.Errorf("Invalid %s text: %v", c.name, err)
+	}
+	return string(decoded), nil
+}
+
+// maxEncodedWordLength is the maximum length of an encoded-word,
+// see RFC 2047 s2.
+const maxEncodedWordLength = 75
+
+// encodeWord encodes s as RFC 2047 encoded-words in the charset,
+// if it needs encoding.
+func (c *charset) encodeWord(s string) (string, error) {
+	encoded, err := c.encode(s)
+	if err != nil {
+		return "", err
+	}
+
+	word := mime.QEncoding.Encode(c.name, encoded)
+	if c.isUTF8() || word == encoded || len(word) <= maxEncodedWordLength {
+		return word, nil
+	}
+
+	// mime.QEncoding only splits UTF-8 text into several encoded-words,
+	// since it can't tell where the characters of other charsets end,
+	// so split the text before transcoding it instead.
+	var words []string
+	var chunk string
+	for _, r := range s {
+		next, err := c.qWord(chunk + string(r))
+		if err != nil {
+			return "", err
+		}
+		if len(next) > maxEncodedWordLength && chunk != "" {
+			words = append(words, word)
+			chunk = ""
+			next, err = c.qWord(string(r))
+			if err != nil {
+				return "", err
+			}
+		}
+		chunk += string(r)
+		word = next
+	}
+	words = append(words, word)
+
+	return strings.Join(words, " "), nil
+}
+
+// qWord encodes s as a single Q encoded-word in the charset.
+// Only characters that are allowed in a phrase are left as they are,
+// so that the word can be used in display names too (RFC 2047 s5).
+func (c *charset) qWord(s string) (string, error) {
+	encoded, err := c.encode(s)
+	if err != nil {
+		return "", err
+	}
+
+	var buf strings.Builder
+	buf.WriteString("=?" + c.name + "?q?")
+	for i := 0; i < len(encoded); i++ {
+		b := encoded[i]
+		switch {
+		case b == ' ':
+			buf.WriteByte('_')
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', strings.IndexByte("!*+-/", b) >= 0:
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(&buf, "=%02X", b)
+		}
+	}
+	buf.WriteString("?=")
+	return buf.String(), nil
+}
+
+// address formats an address for a header. The display name is
+// encoded in the charset.
+func (c *charset) address(address mail.Address) (string, error) {
+	if c.isUTF8() || isASCII(address.Name) {
+		return address.String(), nil
+	}
+
+	name, err := c.encodeWord(address.Name)
+	if err != nil {
+		return "", err
+	}
+	return name + " " + (&mail.Address{Address: address.Address}).String(), nil
+}
+
+// addressList formats a list of addresses and groups for a header,
+// like getAddressListString.
+func (c *charset) addressList(addresses []mail.Address, groups ...AddressGroup) (string, error) {
+	var addressStrings []string
+	if c.isUTF8() {
+		if len(addresses) > 0 {
+			addressStrings = append(addressStrings, getAddressListString(addresses))
+		}
+	} else {
+		for _, address := range addresses {
+			s, err := c.address(address)
+			if err != nil {
+				return "", err
+			}
+			addressStrings = append(addressStrings, s)
+		}
+	}
+
+	for _, group := range groups {
+		s, err := c.group(group)
+		if err != nil {
+			return "", err
+		}
+		addressStrings = append(addressStrings, s)
+	}
+
+	return strings.Join(addressStrings, ","+crlf+" "), nil
+}
+
+// group formats an address group as "name: address, address;".
+func (c *charset) group(group AddressGroup) (string, error) {
+	if group.Name == "" {
+		return "", ErrEmptyGroupName
+	}
+
+	name, err := c.phrase(group.Name)
+	if err != nil {
+		return "", err
+	}
+
+	members, err := c.addressList(group.Addresses)
+	if err != nil {
+		return "", err
+	}
+
+	if members == "" {
+		return name + ":;", nil
+	}
+	return name + ":" + crlf + " " + members + ";", nil
+}
+
+// phrase formats a display name for a header. Like mail.Address,
+// it quotes printable ASCII and encodes anything else.
+func (c *charset) phrase(name string) (string, error) {
+	if isAtomPhrase(name) {
+		return name, nil
+	}
+	for _, r := range name {
+		if r >= ' ' && r <= '~' {
+			continue
+		}
+		if !c.isUTF8() {
+			return c.encodeWord(name)
+		}
+		// Q encoding leaves characters like commas as they are,
+		// which aren't allowed in a phrase (RFC 2047 s5).
+		if strings.ContainsAny(name, "\"#$%&'(),.:;<>@[]^`{|}~") {
+			return mime.BEncoding.Encode(c.name, name), nil
+		}
+		return mime.QEncoding.Encode(c.name, name), nil
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`, nil
+}
+
+// isAtomPhrase reports whether s is a phrase of atoms separated by
+// single spaces, which can be used in a header without quoting.
+func isAtomPhrase(s string) bool {
+	for _, word := range strings.Split(s, " ") {
+		if !isAtom(word) {
+			return false
+		}
+	}
+	return true
+}
+
+// isDotAtom reports whether s is a dot-atom as described in RFC 5322
+// s3.2.3, i.e. atoms separated by single dots, e.g. "mail.domain.com".
+func isDotAtom(s string) bool {
+	for _, atom := range strings.Split(s, ".") {
+		if !isAtom(atom) {
+			return false
+		}
+	}
+	return true
+}
+
+// isAtom reports whether s is a non-empty run of RFC 5322 atext characters.
+func isAtom(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case 'A' <= r && r <= 'Z', 'a' <= r && r <= 'z', '0' <= r && r <= '9':
+		case strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,254 @@
+package gophermail
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A CSSInliner moves the rules of an HTML document's <style> blocks into
+// the style attributes of the elements they match. Many email clients strip
+// <style> blocks, so inlined CSS is the only CSS that reliably survives.
+type CSSInliner interface {
+	InlineCSS(html string) (string, error)
+}
+
+// SimpleCSSInliner is a dependency-free CSSInliner that understands
+// simple selectors: a tag name, optionally followed by any number of
+// .class and #id qualifiers, e.g. "p", ".note", "td.total#sum".
+//
+// Rules it can't inline (@-rules, combinators, pseudo-classes and the like)
+// are kept in a single <style> block in place of the first original one.
+// !important is not taken into account.
+type SimpleCSSInliner struct{}
+
+var (
+	styleBlockRegexp     = regexp.MustCompile(`(?is)<style\b[^>]*>(.*?)</style\s*>`)
+	cssCommentRegexp     = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	startTagRegexp       = regexp.MustCompile(`<([a-zA-Z][a-zA-Z0-9]*)((?:\s+[^\s=>/]+(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'>]+))?)*)\s*(/?)>`)
+	attributeRegexp      = regexp.MustCompile(`\s+([^\s=>/]+)(?:\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+))?`)
+	simpleSelectorRegexp = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9]*)?((?:[.#][a-zA-Z0-9_-]+)*)$`)
+	qualifierRegexp      = regexp.MustCompile(`[.#][a-zA-Z0-9_-]+`)
+)
+
+// cssRule is a rule with a single simple selector.
+type cssRule struct {
+	tag          string
+	ids          []string
+	classes      []string
+	declarations []string
+	order        int
+}
+
+// specificity compares like CSS specificity: ids, then classes, then tags.
+func (r *cssRule) specificity() int {
+	s := len(r.ids)*10000 + len(r.classes)*100
+	if r.tag != "" {
+		s++
+	}
+	return s
+}
+
+func (r *cssRule) matches(tag string, ids, classes map[string]bool) bool {
+	if r.tag != "" && !strings.EqualFold(r.tag, tag) {
+		return false
+	}
+	for _, id := range r.ids {
+		if !ids[id] {
+			return false
+		}
+	}
+	for _, class := range r.classes {
+		if !classes[class] {
+			return false
+		}
+	}
+	return true
+}
+
+// InlineCSS implements CSSInliner.
+func (SimpleCSSInliner) InlineCSS(html string) (string, error) {
+	var rules []*cssRule
+	var unsupported []string
+
+	for _, block := range styleBlockRegexp.FindAllStringSubmatch(html, -1) {
+		r, u := parseCSS(block[1], len(rules))
+		rules = append(rules, r...)
+		unsupported = append(unsupported, u...)
+	}
+	if len(rules) == 0 {
+		return html, nil
+	}
+
+	first := true
+	html = styleBlockRegexp.ReplaceAllStringFunc(html, func(string) string {
+		if first && len(unsupported) > 0 {
+			first = false
+			return "<style>" + strings.Join(unsupported, " ") + "</style>"
+		}
+		return ""
+	})
+
+	html = startTagRegexp.ReplaceAllStringFunc(html, func(tag string) string {
+		return inlineTag(tag, rules)
+	})
+
+	return html, nil
+}
+
+// parseCSS splits a style sheet into rules that can be inlined and
+// the source text of the ones that can't.
+// Rule order numbers start at offset.
+func parseCSS(css string, offset int) ([]*cssRule, []string) {
+	var rules []*cssRule
+	var unsupported []string
+
+	css = cssCommentRegexp.ReplaceAllString(css, "")
+	for {
+		css = strings.TrimSpace(css)
+		if css == "" {
+			break
+		}
+
+		if css[0] == '@' {
+			end := atRuleEnd(css)
+			unsupported = append(unsupported, strings.TrimSpace(css[:end]))
+			css = css[end:]
+			continue
+		}
+
+		open := strings.IndexByte(css, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(css[open:], '}')
+		if end < 0 {
+			break
+		}
+		end += open
+
+		selectors := css[:open]
+		body := css[open+1 : end]
+		css = css[end+1:]
+
+		var declarations []string
+		for _, d := range strings.Split(body, ";") {
+			if d = strings.TrimSpace(d); d != "" {
+				declarations = append(declarations, d)
+			}
+		}
+
+		var rejected []string
+		for _, selector := range strings.Split(selectors, ",") {
+			selector = strings.TrimSpace(selector)
+			m := simpleSelectorRegexp.FindStringSubmatch(selector)
+			if selector == "" || m == nil {
+				rejected = append(rejected, selector)
+				continue
+			}
+
+			rule := &cssRule{
+				tag:          m[1],
+				declarations: declarations,
+				order:        offset + len(rules),
+			}
+			for _, q := range qualifierRegexp.FindAllString(m[2], -1) {
+				if q[0] == '#' {
+					rule.ids = append(rule.ids, q[1:])
+				} else {
+					rule.classes = append(rule.classes, q[1:])
+				}
+			}
+			rules = append(rules, rule)
+		}
+		if len(rejected) > 0 {
+			unsupported = append(unsupported, strings.Join(rejected, ", ")+" {"+body+"}")
+		}
+	}
+
+	return rules, unsupported
+}
+
+// atRuleEnd returns the length of the @-rule at the start of css,
+// which either ends with a semicolon or a balanced block.
+func atRuleEnd(css string) int {
+	depth := 0
+	for i := 0; i < len(css); i++ {
+		switch css[i] {
+		case ';':
+			if depth == 0 {
+				return i + 1
+			}
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth <= 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(css)
+}
+
+// inlineTag adds the declarations of the rules matching a start tag
+// to its style attribute. Declarations already in the attribute win.
+func inlineTag(tag string, rules []*cssRule) string {
+	m := startTagRegexp.FindStringSubmatch(tag)
+	name, attributes, selfClosing := m[1], m[2], m[3]
+
+	ids := map[string]bool{}
+	classes := map[string]bool{}
+	style := ""
+	for _, a := range attributeRegexp.FindAllStringSubmatch(attributes, -1) {
+		value := strings.Trim(a[2], `"'`)
+		switch strings.ToLower(a[1]) {
+		case "id":
+			ids[value] = true
+		case "class":
+			for _, class := range strings.Fields(value) {
+				classes[class] = true
+			}
+		case "style":
+			style = value
+		}
+	}
+
+	var matched []*cssRule
+	for _, rule := range rules {
+		if rule.matches(name, ids, classes) {
+			matched = append(matched, rule)
+		}
+	}
+	if len(matched) == 0 {
+		return tag
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		si, sj := matched[i].specificity(), matched[j].specificity()
+		if si != sj {
+			return si < sj
+		}
+		return matched[i].order < matched[j].order
+	})
+
+	var declarations []string
+	for _, rule := range matched {
+		declarations = append(declarations, rule.declarations...)
+	}
+	if style = strings.TrimSpace(style); style != "" {
+		declarations = append(declarations, strings.TrimSuffix(style, ";"))
+	}
+	if len(declarations) == 0 {
+		return tag
+	}
+	style = strings.Replace(strings.Join(declarations, "; ")+";", `"`, "&quot;", -1)
+
+	attributes = attributeRegexp.ReplaceAllStringFunc(attributes, func(a string) string {
+		if strings.EqualFold(attributeRegexp.FindStringSubmatch(a)[1], "style") {
+			return ""
+		}
+		return a
+	})
+
+	return "<" + name + attributes + ` style="` + style + `"` + selfClosing + ">"
+}
@@ -0,0 +1,63 @@
+package gophermail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/textproto"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestSimpleCSSInliner(t *testing.T) {
+	registerFailHandler(t)
+
+	html := `<html><head><style>
+/* base styles */
+p { color: red; }
+.big { font-size: 20px }
+#main.big, a:hover { font-weight: bold; }
+@media (max-width: 600px) { p { color: blue; } }
+</style></head><body>
+<p class="big" id="main" style="margin: 0">Hi</p>
+<p>There</p>
+<br/>
+</body></html>`
+
+	inlined, err := SimpleCSSInliner{}.InlineCSS(html)
+	expectNoError(err)
+
+	t.Logf("Inlined: \n%s", inlined)
+
+	Expect(inlined).To(ContainSubstring(`<p class="big" id="main" style="color: red; font-size: 20px; font-weight: bold; margin: 0;">Hi</p>`))
+	Expect(inlined).To(ContainSubstring(`<p style="color: red;">There</p>`))
+	Expect(inlined).To(ContainSubstring(`<br/>`))
+	Expect(inlined).To(ContainSubstring(`<style>a:hover { font-weight: bold; } @media (max-width: 600px) { p { color: blue; } }</style>`))
+	Expect(inlined).To(ContainSubstring(`</style></head>`))
+}
+
+func TestCSSInlinerInMessage(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.HTMLBody = `<style>p { color: red; }</style><p>Hi</p>`
+	m.CSSInliner = SimpleCSSInliner{}
+
+	b, err := m.Bytes()
+	expectNoError(err)
+
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(b)))
+	_, err = reader.ReadMIMEHeader()
+	expectNoError(err)
+
+	encoded, err := ioutil.ReadAll(reader.R)
+	expectNoError(err)
+	decoded, err := base64.StdEncoding.DecodeString(string(encoded))
+	expectNoError(err)
+
+	Expect(string(decoded)).To(Equal(`<p style="color: red;">Hi</p>`))
+}
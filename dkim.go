@@ -0,0 +1,227 @@
+package gophermail
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrDKIMMissingKey = errors.New("DKIM private key, selector and domain are required.")
+
+// DefaultDKIMHeaders are the headers signed when DKIMOptions.Headers is empty.
+var DefaultDKIMHeaders = []string{
+	"From",
+	"Reply-To",
+	"Subject",
+	"Date",
+	"To",
+	"Cc",
+	"Message-ID",
+	"MIME-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// DKIMOptions configures DKIM signing (RFC 6376).
+// Signatures use rsa-sha256 with relaxed header
+// and simple body canonicalization.
+type DKIMOptions struct {
+	PrivateKey *rsa.PrivateKey
+
+	// Selector and Domain locate the public key in DNS,
+	// at <Selector>._domainkey.<Domain>.
+	Selector string
+	Domain   string
+
+	// Headers lists the headers to sign. Headers the message doesn't
+	// have are skipped. From is always signed.
+	// Optional. Defaults to DefaultDKIMHeaders.
+	Headers []string
+
+	// Time is the signature timestamp. Optional. Defaults to now.
+	Time time.Time
+}
+
+type dkimSigningSender struct {
+	inner Sender
+	opts  DKIMOptions
+}
+
+func (s *dkimSigningSender) SendMail(msg *Message) error {
+	return s.inner.SendMail(s.sign(msg))
+}
+
+func (s *dkimSigningSender) SendMailContext(ctx context.Context, msg *Message) error {
+	return s.inner.SendMailContext(ctx, s.sign(msg))
+}
+
+// sign returns a shallow copy of msg that is signed by Bytes.
+func (s *dkimSigningSender) sign(msg *Message) *Message {
+	signed := *msg
+	signed.DKIM = &s.opts
+	return &signed
+}
+
+// NewDKIMSigningSender creates a new Sender that signs messages with
+// DKIM and hands them to inner, so that DKIM signing can be combined
+// with any Sender. The messages passed to inner are copies with
+// Message.DKIM set to opts; the originals aren't modified.
+func NewDKIMSigningSender(inner Sender, opts DKIMOptions) Sender {
+	return &dkimSigningSender{
+		inner: inner,
+		opts:  opts,
+	}
+}
+
+// DKIMSign signs an encoded message, such as the output of Bytes,
+// and returns it with a DKIM-Signature header prepended.
+//
+// Setting Message.DKIM makes Bytes sign messages automatically.
+func DKIMSign(message []byte, opts *DKIMOptions) ([]byte, error) {
+	if opts.PrivateKey == nil || opts.Selector == "" || opts.Domain == "" {
+		return nil, ErrDKIMMissingKey
+	}
+
+	var header, body []byte
+	if i := bytes.Index(message, []byte(crlf+crlf)); i >= 0 {
+		header, body = message[:i+len(crlf)], message[i+2*len(crlf):]
+	} else {
+		header = message
+	}
+
+	bodyHash := sha256.Sum256(CanonicalizeBodySimple(body))
+
+	fields := splitHeaderFields(header)
+
+	names := opts.Headers
+	if len(names) == 0 {
+		names = DefaultDKIMHeaders
+	}
+	names = append([]string{"From"}, names...)
+
+	// Hash the selected fields in order, each at most once.
+	hash := sha256.New()
+	var signed []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		field, ok := findHeaderField(fields, name)
+		if !ok {
+			continue
+		}
+		hash.Write([]byte(CanonicalizeHeaderRelaxed(field)))
+		signed = append(signed, name)
+	}
+
+	timestamp := opts.Time
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	tags := []string{
+		"v=1",
+		"a=rsa-sha256",
+		"c=relaxed/simple",
+		"d=" + opts.Domain,
+		"s=" + opts.Selector,
+		fmt.Sprintf("t=%d", timestamp.Unix()),
+		"h=" + strings.Join(signed, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=",
+	}
+	signature := "DKIM-Signature: " + strings.Join(tags, ";"+crlf+" ")
+
+	// The signature header itself is signed with an empty b= tag
+	// and without its trailing CRLF.
+	hash.Write([]byte(strings.TrimSuffix(CanonicalizeHeaderRelaxed(signature+crlf), crlf)))
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, opts.PrivateKey, crypto.SHA256, hash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	signature += base64.StdEncoding.EncodeToString(sig) + crlf
+
+	return append([]byte(signature), message...), nil
+}
+
+// CanonicalizeHeaderRelaxed applies the DKIM "relaxed" header
+// canonicalization (RFC 6376 s3.4.2) to a header field,
+// which includes its trailing CRLF.
+func CanonicalizeHeaderRelaxed(field string) string {
+	i := strings.Index(field, ":")
+	if i < 0 {
+		return field
+	}
+	name := strings.ToLower(strings.TrimRight(field[:i], " \t"))
+	value := field[i+1:]
+
+	// Unfold.
+	value = strings.Replace(value, crlf, "", -1)
+
+	// Reduce runs of whitespace to a single space,
+	// and remove whitespace at the ends.
+	value = strings.Join(strings.FieldsFunc(value, func(r rune) bool {
+		return r == ' ' || r == '\t'
+	}), " ")
+
+	return name + ":" + value + crlf
+}
+
+// CanonicalizeBodySimple applies the DKIM "simple" body
+// canonicalization (RFC 6376 s3.4.3) to a message body:
+// trailing empty lines are removed, and the body is
+// terminated by exactly one CRLF.
+func CanonicalizeBodySimple(body []byte) []byte {
+	for bytes.HasSuffix(body, []byte(crlf+crlf)) {
+		body = body[:len(body)-len(crlf)]
+	}
+	if bytes.Equal(body, []byte(crlf)) || len(body) == 0 {
+		return []byte(crlf)
+	}
+	if !bytes.HasSuffix(body, []byte(crlf)) {
+		body = append(body[:len(body):len(body)], crlf...)
+	}
+	return body
+}
+
+// splitHeaderFields splits a header block into fields, including their
+// continuation lines and trailing CRLF.
+func splitHeaderFields(header []byte) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(string(header), crlf) {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+// findHeaderField finds the last field with the given lower case name,
+// as DKIM signs fields from the bottom up.
+func findHeaderField(fields []string, name string) (string, bool) {
+	for i := len(fields) - 1; i >= 0; i-- {
+		j := strings.Index(fields[i], ":")
+		if j >= 0 && strings.ToLower(strings.TrimSpace(fields[i][:j])) == name {
+			return fields[i], true
+		}
+	}
+	return "", false
+}
@@ -4,8 +4,10 @@ gophermail is a simple package for sending mail using net/smtp.
 Features:
 	- Providing both plain text and HTML message bodies
 	- Attachments with data fed from an io.Reader
+	- Inline images referenced from the HTML body
 	- Reply-To header
 	- To, Cc, and Bcc recipients
+	- DKIM signing
 
 Known Issues: https://github.com/jpoehls/gophermail/issues
 */
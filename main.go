@@ -2,18 +2,20 @@ package gophermail
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
-	"mime/multipart"
 	"net/mail"
 	"net/textproto"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
-
-	"github.com/sloonz/go-qprintable"
 )
 
 // Message Lint: http://tools.ietf.org/tools/msglint/
@@ -22,6 +24,20 @@ const crlf = "\r\n"
 
 var ErrMissingRecipient = errors.New("No recipient specified. At least one To, Cc, or Bcc recipient is required.")
 var ErrMissingFromAddress = errors.New("No from address specified.")
+var ErrInlineImagesWithoutHTMLBody = errors.New("Inline images require an HTML body.")
+var ErrAttachmentStreamed = errors.New("Attachment data was streamed and can't be read again. Increase BufferThreshold to buffer it.")
+var ErrEmptyGroupName = errors.New("Address group name is empty.")
+var ErrBoundaryPrefixTooLong = fmt.Errorf("Boundary prefix is longer than %d characters.", maxBoundaryPrefixLength)
+
+// RFC 2046 limits boundaries to 70 characters.
+const maxBoundaryLength = 70
+
+// The boundary prefix leaves room for at least 30 random hex digits.
+const maxBoundaryPrefixLength = 40
+
+// DefaultFrom is used as the From address of messages that don't set one,
+// e.g. by services with a fixed sending identity. Optional.
+var DefaultFrom mail.Address
 
 // A Message represents an email message.
 // Addresses may be of any form permitted by RFC 5322.
@@ -34,23 +50,139 @@ type Message struct {
 	// Technically this could be a list of addresses but we don't support that. See RFC 2822 s3.6.2.
 	ReplyTo mail.Address // optional
 
+	// EnvelopeFrom, if set, is the SMTP envelope sender (MAIL FROM),
+	// where bounces are sent, e.g. when sending on behalf of the From
+	// address. It isn't shown in the message unless ReturnPathHeader is
+	// set. Optional. Defaults to ResentFrom if it's set, or the From
+	// address.
+	EnvelopeFrom string
+
+	// ReturnPathHeader adds a Return-Path header with the envelope
+	// sender. The receiving server normally adds it on delivery,
+	// so only set it if you need it, e.g. for messages that
+	// are stored instead of sent. Optional.
+	ReturnPathHeader bool
+
 	To, Cc, Bcc []mail.Address
 
+	// ToGroups and CcGroups are added to the To and Cc headers with
+	// the RFC 5322 group syntax, e.g. "Team: a@domain.com, b@domain.com;".
+	// Their members are recipients too. See AddToGroup. Optional.
+	ToGroups, CcGroups []AddressGroup
+
 	Subject string // optional
 
+	// If there are no bodies or calendar, e.g. for a notification that
+	// only needs a subject, the message has an empty us-ascii text/plain body.
 	Body     string // optional
 	HTMLBody string // optional
 
+	// WatchHTMLBody is a simplified HTML body for Apple Watch,
+	// sent as a text/watch-html alternative. Optional.
+	WatchHTMLBody string
+
+	// Calendar is an iCalendar (RFC 5545) object, e.g. a meeting
+	// invitation, sent as a text/calendar alternative after the other
+	// bodies, so that clients that understand it can show the invitation
+	// with accept and decline buttons. See SetCalendar. Optional.
+	Calendar string
+
+	// CalendarMethod is the iTIP method of Calendar, e.g. "REQUEST",
+	// "CANCEL" or "REPLY". It must match the METHOD property of Calendar.
+	// Optional. Defaults to "REQUEST".
+	CalendarMethod string
+
+	// CSSInliner, if set, is applied to HTMLBody before it is encoded.
+	// See SimpleCSSInliner.
+	CSSInliner CSSInliner // optional
+
 	Attachments []Attachment // optional
 
+	// InlineImages are embedded in the HTML body, which can refer to
+	// them as "cid:" followed by their Name, e.g. <img src="cid:logo.png">.
+	// They require HTMLBody to be set. Their Encoding applies too,
+	// e.g. quoted-printable keeps SVG images readable.
+	InlineImages []Attachment // optional
+
 	// Extra mail headers.
 	Headers mail.Header
+
+	// HeaderOrder lists headers that should come first, in this order,
+	// for systems that expect a specific order, e.g. "Date", "From",
+	// "To", "Subject". The other headers follow, sorted by name.
+	// A Resent-* block is always emitted above all of them. Optional.
+	HeaderOrder []string
+
+	// MaxRecipients limits the total number of To, Cc and Bcc recipients,
+	// to guard against runaway loops adding recipients.
+	// Optional. Zero means no limit.
+	MaxRecipients int
+
+	// Resent fields are emitted as a Resent-* header block above the
+	// other headers when forwarding the message unchanged. See SetResent.
+	// If ResentFrom is set, the message is sent to ResentTo instead of
+	// the To, Cc and Bcc recipients, and ResentTo is required.
+	ResentFrom mail.Address   // optional
+	ResentTo   []mail.Address // optional
+
+	// BoundaryPrefix is prepended to the random MIME boundaries
+	// to make them easy to spot when reading raw messages.
+	// Optional. At most 40 characters from the set allowed by RFC 2046.
+	BoundaryPrefix string
+
+	// DKIM, if set, makes Bytes sign the message with DKIM.
+	// Optional.
+	DKIM *DKIMOptions
+
+	// BufferThreshold enables buffering of attachment and inline image
+	// Data. Data shorter than BufferThreshold bytes is read into memory
+	// the first time Bytes is called, so that later calls, e.g. retries,
+	// produce the whole message again. Longer Data is streamed, which
+	// keeps memory use flat for huge attachments, but it can only be
+	// read once, and later calls return ErrAttachmentStreamed.
+	// Bytes replaces Data with a reader that tracks this.
+	// Optional. Zero disables buffering and the tracking: Data is read
+	// by every call, and is usually empty after the first.
+	BufferThreshold int64
+
+	// MessageIDDomain is the domain of the generated Message-ID header,
+	// as in <random@MessageIDDomain>, e.g. "mail.domain.com". It must be
+	// a dot-atom. A Message-ID is generated unless Headers has one.
+	// Optional. Defaults to the domain of the From address, or the
+	// local hostname if that has none.
+	MessageIDDomain string
+
+	// Priority, if not PriorityNormal, is shown by mail clients such as
+	// Outlook and Thunderbird, using the X-Priority, X-MSMail-Priority
+	// and Importance headers. Those in Headers take precedence.
+	// Optional.
+	Priority Priority
+
+	// Charset is the character set of the text bodies, the subject and
+	// the display names, e.g. "iso-8859-2" or "shift_jis" for legacy
+	// systems. The text is transcoded from UTF-8, and Bytes returns an
+	// error if a character can't be represented in it.
+	// Optional. Defaults to utf-8.
+	Charset string
+
+	// Boundary, if set, replaces the random MIME boundaries, making the
+	// output reproducible, e.g. for golden tests or deduplication.
+	// It is used by the top level multipart container; nested containers
+	// prepend a prefix such as "alt_" or "rel_".
+	// It must be at most 66 characters from the set allowed by RFC 2046,
+	// and can't end with a space.
+	// It takes precedence over BoundaryPrefix. Optional.
+	Boundary string
 }
 
 // Sender can send messages.
 type Sender interface {
 	// SendMail sends the given message.
 	SendMail(msg *Message) error
+
+	// SendMailContext sends the given message,
+	// giving up when ctx is done.
+	SendMailContext(ctx context.Context, msg *Message) error
 }
 
 // appendMailAddresses parses any number of addresses and appends them to a
@@ -72,6 +204,22 @@ func appendMailAddresses(dest *[]mail.Address, addresses ...string) error {
 	return err
 }
 
+// appendMailAddressList parses an RFC 5322 address list, e.g.
+// "a@domain.com, Bob <b@domain.com>", and appends its addresses to
+// a destination slice. If the list fails to parse, none of them
+// are appended.
+func appendMailAddressList(dest *[]mail.Address, list string) error {
+	parsed, err := mail.ParseAddressList(list)
+	if err != nil {
+		return err
+	}
+
+	for _, address := range parsed {
+		*dest = append(*dest, *address)
+	}
+	return nil
+}
+
 // setMailAddress parses an address and sets it to a destination mail address.
 func setMailAddress(dest *mail.Address, address string) error {
 	parsed, err := mail.ParseAddress(address)
@@ -82,6 +230,16 @@ func setMailAddress(dest *mail.Address, address string) error {
 	return nil
 }
 
+// from returns the From address of the message,
+// falling back to DefaultFrom if it isn't set.
+func (m *Message) from() mail.Address {
+	var emptyAddress mail.Address
+	if m.From == emptyAddress {
+		return DefaultFrom
+	}
+	return m.From
+}
+
 // SetFrom creates a mail.Address and assigns it to the message's From
 // field.
 func (m *Message) SetFrom(address string) error {
@@ -94,6 +252,39 @@ func (m *Message) SetReplyTo(address string) error {
 	return setMailAddress(&m.ReplyTo, address)
 }
 
+// SetResent marks the message as being forwarded unchanged from the
+// from address to the to address list, as described in RFC 5322 s3.6.6.
+// Bytes will prepend Resent-Date, Resent-From, Resent-To and
+// Resent-Message-ID headers to the original headers.
+// The message will be sent from the from address to the to addresses,
+// not to the original recipients.
+func (m *Message) SetResent(from, to string) error {
+	var resentFrom mail.Address
+	err := setMailAddress(&resentFrom, from)
+	if err != nil {
+		return err
+	}
+
+	resentTo, err := mail.ParseAddressList(to)
+	if err != nil {
+		return err
+	}
+
+	m.ResentFrom = resentFrom
+	m.ResentTo = nil
+	for _, address := range resentTo {
+		m.ResentTo = append(m.ResentTo, *address)
+	}
+	return nil
+}
+
+// SetCalendar sets the iCalendar object sent with the message, and its
+// method, e.g. "REQUEST" for a meeting invitation.
+func (m *Message) SetCalendar(ics, method string) {
+	m.Calendar = ics
+	m.CalendarMethod = method
+}
+
 // AddTo creates a mail.Address and adds it to the list of To addresses in the
 // message
 func (m *Message) AddTo(addresses ...string) error {
@@ -112,6 +303,178 @@ func (m *Message) AddBcc(addresses ...string) error {
 	return appendMailAddresses(&m.Bcc, addresses...)
 }
 
+// AttachFile reads the file at path and adds it to the message's
+// attachments. The attachment is named after the file, and its
+// content type is inferred from the extension, falling back to
+// application/octet-stream.
+//
+// The file is read into memory and closed before AttachFile returns,
+// so there is nothing to clean up, and the attachment can be encoded
+// any number of times.
+func (m *Message) AttachFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	m.Attachments = append(m.Attachments, Attachment{
+		Name:        filepath.Base(path),
+		ContentType: contentType,
+		Data:        &bufferedData{data: data},
+	})
+	return nil
+}
+
+// AddToList parses a comma separated list of addresses, which may have
+// quoted display names containing commas, and adds them to the list
+// of To addresses in the message. If the list is malformed, none of
+// the addresses are added.
+func (m *Message) AddToList(list string) error {
+	return appendMailAddressList(&m.To, list)
+}
+
+// AddCcList adds a list of addresses to the Cc addresses, like AddToList.
+func (m *Message) AddCcList(list string) error {
+	return appendMailAddressList(&m.Cc, list)
+}
+
+// AddBccList adds a list of addresses to the Bcc addresses, like AddToList.
+func (m *Message) AddBccList(list string) error {
+	return appendMailAddressList(&m.Bcc, list)
+}
+
+// AddToGroup adds a group of To recipients to the message, which is
+// rendered with the group syntax. addresses may be empty, e.g. for
+// "Undisclosed recipients:;" when all the recipients are Bcc.
+// name can't be empty.
+// If any of the addresses fail to parse, the group isn't added.
+func (m *Message) AddToGroup(name string, addresses ...string) error {
+	return appendAddressGroup(&m.ToGroups, name, addresses...)
+}
+
+// AddCcGroup adds a group of Cc recipients to the message,
+// like AddToGroup.
+func (m *Message) AddCcGroup(name string, addresses ...string) error {
+	return appendAddressGroup(&m.CcGroups, name, addresses...)
+}
+
+// appendAddressGroup parses the addresses of a group and appends it
+// to a destination slice.
+func appendAddressGroup(dest *[]AddressGroup, name string, addresses ...string) error {
+	if name == "" {
+		return ErrEmptyGroupName
+	}
+	group := AddressGroup{Name: name}
+	err := appendMailAddresses(&group.Addresses, addresses...)
+	if err != nil {
+		return err
+	}
+	*dest = append(*dest, group)
+	return nil
+}
+
+// groupAddresses returns the members of groups.
+func groupAddresses(groups []AddressGroup) []mail.Address {
+	var addresses []mail.Address
+	for _, group := range groups {
+		addresses = append(addresses, group.Addresses...)
+	}
+	return addresses
+}
+
+// NeedsEightBit reports whether any of the message's addresses, subject,
+// bodies or extra headers contain non-ASCII characters.
+// Servers should advertise SMTPUTF8 (for addresses) or 8BITMIME
+// before such a message is sent unencoded.
+func (m *Message) NeedsEightBit() bool {
+	addresses := []mail.Address{m.from(), m.ReplyTo}
+	addresses = append(addresses, m.To...)
+	addresses = append(addresses, m.Cc...)
+	addresses = append(addresses, groupAddresses(m.ToGroups)...)
+	addresses = append(addresses, groupAddresses(m.CcGroups)...)
+	addresses = append(addresses, m.Bcc...)
+	addresses = append(addresses, m.ResentFrom)
+	addresses = append(addresses, m.ResentTo...)
+	for _, address := range addresses {
+		if !isASCII(address.Name) || !isASCII(address.Address) {
+			return true
+		}
+	}
+
+	if !isASCII(m.Subject) || !isASCII(m.Body) || !isASCII(m.HTMLBody) || !isASCII(m.WatchHTMLBody) || !isASCII(m.Calendar) {
+		return true
+	}
+
+	for _, groups := range [][]AddressGroup{m.ToGroups, m.CcGroups} {
+		for _, group := range groups {
+			if !isASCII(group.Name) {
+				return true
+			}
+		}
+	}
+
+	for k, vs := range m.Headers {
+		if !isASCII(k) {
+			return true
+		}
+		for _, v := range vs {
+			if !isASCII(v) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isASCII reports whether s consists only of 7-bit ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// Priority is the priority of a message, as shown by mail clients.
+type Priority int
+
+const (
+	// PriorityNormal is the default, which adds no headers.
+	PriorityNormal Priority = iota
+	PriorityLow
+	PriorityHigh
+)
+
+// priorityHeaders are the headers for each priority.
+// Some clients only understand one of them, so all are set.
+var priorityHeaders = map[Priority][][2]string{
+	PriorityLow: {
+		{"X-Priority", "5"},
+		{"X-MSMail-Priority", "Low"},
+		{"Importance", "low"},
+	},
+	PriorityHigh: {
+		{"X-Priority", "1"},
+		{"X-MSMail-Priority", "High"},
+		{"Importance", "high"},
+	},
+}
+
+// An AddressGroup is a named group of addresses, as described in
+// RFC 5322 s3.4.
+type AddressGroup struct {
+	// Name is the display name of the group. It can't be empty.
+	Name      string
+	Addresses []mail.Address
+}
+
 // An Attachment represents an email attachment.
 type Attachment struct {
 	// Name must be set to a valid file name.
@@ -123,31 +486,178 @@ type Attachment struct {
 	ContentType string
 
 	Data io.Reader
+
+	// FilenameParams controls which headers carry Name.
+	// Defaults to FilenameBoth.
+	FilenameParams FilenameParams
+
+	// Encoding is the Content-Transfer-Encoding of Data.
+	// Defaults to EncodingBase64.
+	Encoding TransferEncoding
+}
+
+// TransferEncoding selects the Content-Transfer-Encoding of an attachment.
+type TransferEncoding int
+
+const (
+	// EncodingBase64 encodes attachments with base64,
+	// which is safe for any content.
+	EncodingBase64 TransferEncoding = iota
+
+	// EncodingQuotedPrintable encodes attachments with quoted-printable,
+	// which keeps mostly ASCII text, e.g. logs and CSV files, small and
+	// readable in the raw message. Line breaks are only converted to CRLF
+	// in text/* attachments; in others they are encoded, so that binary
+	// data survives unchanged.
+	EncodingQuotedPrintable
+
+	// EncodingAuto looks at the start of the attachment and uses
+	// quoted-printable if it is mostly printable ASCII text,
+	// and base64 otherwise.
+	EncodingAuto
+)
+
+// FilenameParams selects the header parameters that give
+// an attachment's file name.
+type FilenameParams int
+
+const (
+	// FilenameBoth sets both the Content-Disposition filename parameter
+	// and the Content-Type name parameter, which some legacy clients
+	// read instead.
+	FilenameBoth FilenameParams = iota
+
+	// FilenameDisposition only sets the Content-Disposition
+	// filename parameter, as specified by RFC 2183.
+	FilenameDisposition
+
+	// FilenameContentType only sets the legacy Content-Type
+	// name parameter.
+	FilenameContentType
+)
+
+// TestString gets the encoded MIME message as a string,
+// for use in test assertions. If normalizeNewlines is true,
+// CRLF line endings are replaced with LF.
+func (m *Message) TestString(normalizeNewlines bool) (string, error) {
+	b, err := m.Bytes()
+	if err != nil {
+		return "", err
+	}
+
+	s := string(b)
+	if normalizeNewlines {
+		s = strings.Replace(s, crlf, "\n", -1)
+	}
+	return s, nil
 }
 
 // Bytes gets the encoded MIME message.
 func (m *Message) Bytes() ([]byte, error) {
 	var buffer = &bytes.Buffer{}
 
+	_, err := m.WriteTo(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// WriteTo writes the encoded MIME message to w. Unlike Bytes, it doesn't
+// hold the whole message in memory: attachments are streamed from their
+// Data through the encoder into w. The output is the same as Bytes'.
+//
+// If the message is signed with DKIM, it has to be encoded in memory
+// first, since the signature goes above the rest of the message.
+//
+// Most problems with the message are reported before anything is
+// written, including a HeaderInjectionError if a header name, value
+// or address contains a newline, but w can get part of the message
+// if reading an attachment fails.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	e, err := m.encode()
+	if err != nil {
+		return 0, unwrapAttachmentError(err)
+	}
+
+	if m.DKIM != nil {
+		var buffer = &bytes.Buffer{}
+		_, err = e.WriteTo(buffer)
+		if err != nil {
+			return 0, unwrapAttachmentError(err)
+		}
+
+		signed, err := DKIMSign(buffer.Bytes(), m.DKIM)
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := w.Write(signed)
+		return int64(n), err
+	}
+
+	n, err := e.WriteTo(w)
+	return n, unwrapAttachmentError(err)
+}
+
+// An encodedMessage is a message that is ready to be written:
+// its header is encoded, and its MIME tree is built.
+type encodedMessage struct {
+	header  []byte
+	body    *mimePart
+	written bool
+}
+
+// encode checks and encodes the header of the message and builds its
+// MIME tree, without reading the attachments beyond what is needed
+// to choose their encodings.
+func (m *Message) encode() (*encodedMessage, error) {
+	var buffer = &bytes.Buffer{}
+
+	// User input must not be able to add headers or start the body.
+	if errs := m.headerInjectionErrors(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+
 	header := textproto.MIMEHeader{}
 
-	var err error
+	cs, err := m.charset()
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.validateMessageIDDomain()
+	if err != nil {
+		return nil, err
+	}
 
 	// Require To, Cc, or Bcc
 	// We'll parse the slices into a list of addresses
 	// and then make sure that list isn't empty.
-	toAddrs := getAddressListString(m.To)
-	ccAddrs := getAddressListString(m.Cc)
-	bccAddrs := getAddressListString(m.Bcc)
+	toAddrs, err := cs.addressList(m.To, m.ToGroups...)
+	if err != nil {
+		return nil, err
+	}
+	ccAddrs, err := cs.addressList(m.Cc, m.CcGroups...)
+	if err != nil {
+		return nil, err
+	}
 
 	var hasTo = toAddrs != ""
 	var hasCc = ccAddrs != ""
-	var hasBcc = bccAddrs != ""
 
-	if !hasTo && !hasCc && !hasBcc {
+	// Groups without members are only shown in the headers,
+	// so they don't count as recipients.
+	if m.recipientCount() == 0 || m.missingResentRecipient() {
 		return nil, ErrMissingRecipient
 	}
 
+	err = m.checkRecipientLimit()
+	if err != nil {
+		return nil, err
+	}
+
 	if hasTo {
 		header.Add("To", toAddrs)
 	}
@@ -160,29 +670,54 @@ func (m *Message) Bytes() ([]byte, error) {
 
 	var emptyAddress mail.Address
 	// Require From address
-	if m.From == emptyAddress {
+	from := m.from()
+	if from == emptyAddress {
 		return nil, ErrMissingFromAddress
 	}
-	header.Add("From", m.From.String())
+	fromAddr, err := cs.address(from)
+	if err != nil {
+		return nil, err
+	}
+	header.Add("From", fromAddr)
 
 	// Optional ReplyTo
 	if m.ReplyTo != emptyAddress {
-		header.Add("Reply-To", m.ReplyTo.String())
+		replyTo, err := cs.address(m.ReplyTo)
+		if err != nil {
+			return nil, err
+		}
+		header.Add("Reply-To", replyTo)
 	}
 
 	// Optional Subject
 	if m.Subject != "" {
-		quotedSubject := qEncodeAndWrap(m.Subject, 9 /* len("Subject: ") */)
-		if quotedSubject[0] == '"' {
-			// qEncode used simple quoting, which adds quote
-			// characters to email subjects.
-			quotedSubject = quotedSubject[1 : len(quotedSubject)-1]
+		var quotedSubject string
+		if cs.isUTF8() {
+			quotedSubject = qEncodeAndWrap(m.Subject, 9 /* len("Subject: ") */)
+			if quotedSubject[0] == '"' {
+				// qEncode used simple quoting, which adds quote
+				// characters to email subjects.
+				quotedSubject = quotedSubject[1 : len(quotedSubject)-1]
+			}
+		} else {
+			quotedSubject, err = cs.encodeWord(m.Subject)
+			if err != nil {
+				return nil, err
+			}
 		}
 		header.Add("Subject", quotedSubject)
 	}
 
+	// The Resent-* block goes above all other headers.
+	if m.ResentFrom != emptyAddress {
+		err = m.writeResentHeader(buffer, cs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Date
-	if _, ok := m.Headers["Date"]; !ok {
+	if !hasHeader(m.Headers, "Date") {
 		header.Add("Date", time.Now().UTC().Format(time.RFC822))
 	}
 
@@ -190,178 +725,310 @@ func (m *Message) Bytes() ([]byte, error) {
 		header[k] = v
 	}
 
-	header.Add("MIME-Version", "1.0")
-
-	var mixedw *multipart.Writer
-	var hasAttachments = m.Attachments != nil && len(m.Attachments) > 0
-	if hasAttachments {
-		// Top level multipart writer for our `multipart/mixed` body.
-		// only needed if we have attachments
-		mixedw = multipart.NewWriter(buffer)
-		header.Add("Content-Type", fmt.Sprintf("multipart/mixed;%s boundary=%s", crlf, mixedw.Boundary()))
-		err = writeHeader(buffer, header)
+	if !hasHeader(m.Headers, "Message-ID") {
+		messageID, err := generateMessageID(m.messageIDDomain())
 		if err != nil {
 			return nil, err
 		}
-		header = textproto.MIMEHeader{}
-		// Write the start of our `multipart/mixed` body.
-		_, err = fmt.Fprintf(buffer, "--%s%s", mixedw.Boundary(), crlf)
-		if err != nil {
-			return nil, err
+		header.Add("Message-ID", messageID)
+	}
+
+	if m.ReturnPathHeader && !hasHeader(m.Headers, "Return-Path") {
+		header.Add("Return-Path", "<"+m.envelopeFrom()+">")
+	}
+
+	for _, field := range priorityHeaders[m.Priority] {
+		if !hasHeader(m.Headers, field[0]) {
+			// Not canonicalized, to keep the usual "X-MSMail" spelling.
+			header[field[0]] = []string{field[1]}
 		}
 	}
 
-	var altw *multipart.Writer
-	if m.Body != "" && m.HTMLBody != "" {
-		// Nested multipart writer for our `multipart/alternative` body.
-		altw = multipart.NewWriter(buffer)
+	if !hasHeader(m.Headers, "MIME-Version") {
+		header.Add("MIME-Version", "1.0")
+	}
 
-		header.Add("Content-Type", fmt.Sprintf("multipart/alternative;%s boundary=%s", crlf, altw.Boundary()))
-		err := writeHeader(buffer, header)
+	if m.Boundary != "" {
+		err = validateBoundary(m.Boundary)
+	} else {
+		err = validateBoundaryPrefix(m.BoundaryPrefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.bufferAttachments()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := m.bodyPart(cs)
+	if err != nil {
+		return nil, err
+	}
+
+	// The top level part's headers are merged into the message headers.
+	for k, v := range body.header {
+		header[k] = v
+	}
+
+	err = writeHeader(buffer, header, m.HeaderOrder...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encodedMessage{header: buffer.Bytes(), body: body}, nil
+}
+
+// WriteTo writes the message to w.
+// It can only be called once, since it consumes the attachments.
+// Errors reading the attachments are returned as attachmentErrors.
+func (e *encodedMessage) WriteTo(w io.Writer) (int64, error) {
+	if e.written {
+		return 0, ErrAttachmentStreamed
+	}
+	e.written = true
+
+	cw := &countingWriter{w: w}
+
+	_, err := cw.Write(e.header)
+	if err != nil {
+		return cw.n, err
+	}
+
+	err = e.body.writeBody(cw)
+	if err != nil {
+		return cw.n, err
+	}
+
+	if !e.body.isMultipart() {
+		_, err = fmt.Fprintf(cw, "%s", crlf)
 		if err != nil {
-			return nil, err
+			return cw.n, err
 		}
 	}
 
-	// Only include an empty plain text body if the html body is also empty.
-	if m.Body != "" || m.Body == "" && m.HTMLBody == "" {
-		if altw != nil {
-			header = textproto.MIMEHeader{}
-		}
-		header.Add("Content-Type", "text/plain; charset=utf-8")
-		header.Add("Content-Transfer-Encoding", "quoted-printable")
-		//header.Add("Content-Transfer-Encoding", "base64")
+	return cw.n, nil
+}
 
-		var writer io.Writer
-		if altw != nil {
-			partw, err := altw.CreatePart(header)
-			if err != nil {
-				return nil, err
-			}
-			writer = partw
-		} else {
-			writer = buffer
-			err = writeHeader(buffer, header)
-			if err != nil {
-				return nil, err
-			}
-		}
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
 
-		bodyBytes := []byte(m.Body)
-		//encoder := NewBase64MimeEncoder(writer)
-		encoder := qprintable.NewEncoder(qprintable.DetectEncoding(m.Body), writer)
-		_, err = encoder.Write(bodyBytes)
+// EnsureRequiredHeaders adds the Date, Message-ID and MIME-Version
+// headers to Headers if they are missing, so that the message is valid
+// even when it is passed on unchanged, and returns the names of the
+// headers it added, e.g. for logging.
+// Headers that are already set, in any case, are left alone.
+func (m *Message) EnsureRequiredHeaders() ([]string, error) {
+	var added []string
+
+	if m.Headers == nil {
+		m.Headers = mail.Header{}
+	}
+
+	if !hasHeader(m.Headers, "Date") {
+		m.Headers["Date"] = []string{time.Now().UTC().Format(time.RFC822)}
+		added = append(added, "Date")
+	}
+
+	if !hasHeader(m.Headers, "Message-ID") {
+		err := m.validateMessageIDDomain()
 		if err != nil {
-			return nil, err
+			return added, err
 		}
-		err = encoder.Close()
+		messageID, err := generateMessageID(m.messageIDDomain())
 		if err != nil {
-			return nil, err
+			return added, err
 		}
+		m.Headers["Message-Id"] = []string{messageID}
+		added = append(added, "Message-ID")
 	}
 
-	if m.HTMLBody != "" {
-		if altw != nil {
-			header = textproto.MIMEHeader{}
-		}
-		header.Add("Content-Type", "text/html; charset=utf-8")
-		//header.Add("Content-Transfer-Encoding", "quoted-printable")
-		header.Add("Content-Transfer-Encoding", "base64")
+	if !hasHeader(m.Headers, "MIME-Version") {
+		m.Headers["Mime-Version"] = []string{"1.0"}
+		added = append(added, "MIME-Version")
+	}
 
-		var writer io.Writer
-		if altw != nil {
-			partw, err := altw.CreatePart(header)
-			if err != nil {
-				return nil, err
-			}
-			writer = partw
-		} else {
-			writer = buffer
-			err = writeHeader(buffer, header)
-			if err != nil {
-				return nil, err
-			}
+	return added, nil
+}
+
+// envelopeFrom returns the SMTP envelope sender of the message.
+func (m *Message) envelopeFrom() string {
+	if m.EnvelopeFrom != "" {
+		return m.EnvelopeFrom
+	}
+	if m.isResent() {
+		return m.ResentFrom.Address
+	}
+	return m.from().Address
+}
+
+// isResent reports whether the message has a ResentFrom address.
+func (m *Message) isResent() bool {
+	var emptyAddress mail.Address
+	return m.ResentFrom != emptyAddress
+}
+
+// validateMessageIDDomain checks that MessageIDDomain
+// can be used in a Message-ID header.
+func (m *Message) validateMessageIDDomain() error {
+	if m.MessageIDDomain != "" && !isDotAtom(m.MessageIDDomain) {
+		return fmt.Errorf("Message-ID domain %q is not a valid domain.", m.MessageIDDomain)
+	}
+	return nil
+}
+
+// messageIDDomain returns the domain of generated Message-IDs.
+// If it is empty, generateMessageID uses the local hostname.
+func (m *Message) messageIDDomain() string {
+	if m.MessageIDDomain != "" {
+		return m.MessageIDDomain
+	}
+	return addressDomain(m.from().Address)
+}
+
+// hasHeader reports whether header has a key,
+// ignoring case since header names are case insensitive.
+func hasHeader(header mail.Header, key string) bool {
+	for k := range header {
+		if strings.EqualFold(k, key) {
+			return true
 		}
+	}
+	return false
+}
 
-		htmlBodyBytes := []byte(m.HTMLBody)
-		encoder := NewBase64MimeEncoder(writer)
-		//encoder := qprintable.NewEncoder(qprintable.DetectEncoding(m.HTMLBody), writer)
-		_, err = encoder.Write(htmlBodyBytes)
+// writeResentHeader writes the Resent-* header block to the io.Writer.
+// Addresses are encoded in charset cs.
+func (m *Message) writeResentHeader(w io.Writer, cs *charset) error {
+	messageID, err := generateMessageID(addressDomain(m.ResentFrom.Address))
+	if err != nil {
+		return err
+	}
+
+	resentFrom, err := cs.address(m.ResentFrom)
+	if err != nil {
+		return err
+	}
+
+	fields := [][2]string{
+		{"Resent-Date", time.Now().UTC().Format(time.RFC822)},
+		{"Resent-From", resentFrom},
+	}
+	if len(m.ResentTo) > 0 {
+		resentTo, err := cs.addressList(m.ResentTo)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		err = encoder.Close()
+		fields = append(fields, [2]string{"Resent-To", resentTo})
+	}
+	fields = append(fields, [2]string{"Resent-Message-ID", messageID})
+
+	for _, field := range fields {
+		_, err = fmt.Fprintf(w, "%s: %s%s", field[0], field[1], crlf)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
+	return nil
+}
 
-	if altw != nil {
-		altw.Close()
-	} else {
-		_, err = fmt.Fprintf(buffer, "%s", crlf)
+// generateMessageID generates a new, globally unique message id
+// in the form <random@domain>, as used by the Message-ID header.
+// If domain is empty, the local hostname is used.
+func generateMessageID(domain string) (string, error) {
+	if domain == "" {
+		hostname, err := os.Hostname()
 		if err != nil {
-			return nil, err
+			return "", err
 		}
+		domain = hostname
 	}
 
-	if hasAttachments {
+	var random [16]byte
+	_, err := rand.Read(random[:])
+	if err != nil {
+		return "", err
+	}
 
-		for _, attachment := range m.Attachments {
+	return fmt.Sprintf("<%x.%d@%s>", random, time.Now().UnixNano(), domain), nil
+}
 
-			contentType := attachment.ContentType
-			if contentType == "" {
-				contentType = mime.TypeByExtension(filepath.Ext(attachment.Name))
-				if contentType == "" {
-					contentType = "application/octet-stream"
-				}
-			}
+// addressDomain returns the domain part of an email address,
+// or an empty string if it doesn't have one.
+func addressDomain(address string) string {
+	i := strings.LastIndex(address, "@")
+	if i < 0 {
+		return ""
+	}
+	return address[i+1:]
+}
 
-			header := textproto.MIMEHeader{}
-			header.Add("Content-Type", contentType)
-			header.Add("Content-Disposition", fmt.Sprintf(`attachment;%s filename="%s"`, crlf, attachment.Name))
-			header.Add("Content-Transfer-Encoding", "base64")
+// boundaryParam formats a boundary as a Content-Type parameter value,
+// quoting it if it contains characters that aren't allowed in a token.
+func boundaryParam(boundary string) string {
+	if strings.ContainsAny(boundary, `()<>@,;:\"/[]?= `) {
+		return `"` + boundary + `"`
+	}
+	return boundary
+}
 
-			attachmentPart, err := mixedw.CreatePart(header)
-			if err != nil {
-				return nil, err
+// writeHeader writes the specified MIMEHeader to the io.Writer.
+// Headers listed in order come first, in that order,
+// followed by the rest sorted by key.
+// Each header is written as "Key: value", and values will be trimmed,
+// including the lines of folded values, but otherwise left alone.
+// Headers with multiple values are not supported and will return an error.
+func writeHeader(w io.Writer, header textproto.MIMEHeader, order ...string) error {
+	// Sort the keys so that the output is reproducible.
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if len(order) > 0 {
+		position := map[string]int{}
+		for i, k := range order {
+			k = textproto.CanonicalMIMEHeaderKey(k)
+			if _, ok := position[k]; !ok {
+				position[k] = i
 			}
-
-			if attachment.Data != nil {
-				encoder := NewBase64MimeEncoder(attachmentPart)
-				_, err = io.Copy(encoder, attachment.Data)
-				if err != nil {
-					return nil, err
-				}
-				err = encoder.Close()
-				if err != nil {
-					return nil, err
-				}
+		}
+		rank := func(k string) int {
+			if i, ok := position[textproto.CanonicalMIMEHeaderKey(k)]; ok {
+				return i
 			}
+			return len(order)
 		}
-
-		mixedw.Close()
+		sort.SliceStable(keys, func(i, j int) bool {
+			return rank(keys[i]) < rank(keys[j])
+		})
 	}
 
-	return buffer.Bytes(), nil
-}
-
-// writeHeader writes the specified MIMEHeader to the io.Writer.
-// Header values will be trimmed but otherwise left alone.
-// Headers with multiple values are not supported and will return an error.
-func writeHeader(w io.Writer, header textproto.MIMEHeader) error {
-	for k, vs := range header {
-		_, err := fmt.Fprintf(w, "%s: ", k)
+	for _, k := range keys {
+		vs := header[k]
+		_, err := fmt.Fprintf(w, "%s:", k)
 		if err != nil {
 			return err
 		}
 
 		for i, v := range vs {
-			v = textproto.TrimString(v)
-
-			_, err := fmt.Fprintf(w, "%s", v)
-			if err != nil {
-				return err
+			v = trimHeaderValue(v)
+			if v != "" {
+				_, err := fmt.Fprintf(w, " %s", v)
+				if err != nil {
+					return err
+				}
 			}
 
 			if i < len(vs)-1 {
@@ -384,6 +1051,16 @@ func writeHeader(w io.Writer, header textproto.MIMEHeader) error {
 	return nil
 }
 
+// trimHeaderValue trims the whitespace around a header value,
+// and the trailing whitespace of each of its lines if it is folded.
+func trimHeaderValue(v string) string {
+	lines := strings.Split(textproto.TrimString(v), crlf)
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.Join(lines, crlf)
+}
+
 // qEncode encodes a string with Q encoding defined as an 'encoded-word' in RFC 2047.
 // The maximum encoded word length of 75 characters is not accounted for.
 // Use qEncodeAndWrap if you need that.
@@ -3,7 +3,11 @@ package gophermail
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	. "github.com/onsi/gomega"
 	"io"
@@ -12,9 +16,14 @@ import (
 	"mime/multipart"
 	"net/mail"
 	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
+
+	"golang.org/x/text/encoding/ianaindex"
 )
 
 // registerFailHandler registers a gomega fail handler that calls t.Fatal
@@ -286,3 +295,836 @@ func TestManualDate(t *testing.T) {
 
 	Expect(parsedTime.Equal(msgTime.Truncate(time.Minute))).To(BeTrue(), "Time in Date header is not what we specified")
 }
+
+func TestNeedsEightBit(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	expectNoError(m.SetFrom("Doman Sender <sender@domain.com>"))
+	expectNoError(m.AddTo("First person <to_1@domain.com>"))
+	m.Subject = "Plain subject"
+	m.Body = "Plain body"
+	m.HTMLBody = "<p>Plain body</p>"
+
+	Expect(m.NeedsEightBit()).To(BeFalse(), "pure ASCII message needs 8bit")
+
+	m.Body = "Accented body áűőú"
+	Expect(m.NeedsEightBit()).To(BeTrue(), "accented body does not need 8bit")
+
+	m.Body = "Plain body"
+	expectNoError(m.AddCc("Ádám <adam@domain.com>"))
+	Expect(m.NeedsEightBit()).To(BeTrue(), "accented display name does not need 8bit")
+}
+
+func TestBoundaryPrefix(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.Body = "Test message"
+	m.HTMLBody = "<p>Test message</p>"
+	m.Attachments = []Attachment{{
+		Name: "test.txt",
+		Data: strings.NewReader("Test attachment"),
+	}}
+	m.BoundaryPrefix = "gophermail-"
+
+	b, err := m.Bytes()
+	expectNoError(err)
+
+	t.Logf("Bytes: \n%s", b)
+
+	boundaries := regexp.MustCompile(`boundary=(\S+)`).FindAllSubmatch(b, -1)
+	Expect(boundaries).To(HaveLen(2), "expected a mixed and an alternative boundary")
+	for _, boundary := range boundaries {
+		Expect(string(boundary[1])).To(HavePrefix("gophermail-"), "boundary is missing the prefix")
+		Expect(len(boundary[1])).To(BeNumerically("<=", maxBoundaryLength), "boundary is too long")
+	}
+	Expect(boundaries[0][1]).NotTo(Equal(boundaries[1][1]), "boundaries are not unique")
+
+	m.BoundaryPrefix = strings.Repeat("x", maxBoundaryPrefixLength+1)
+	_, err = m.Bytes()
+	Expect(err).To(Equal(ErrBoundaryPrefixTooLong))
+	Expect(m.Validate()).To(Equal(err))
+
+	for _, prefix := range []string{"bad<prefix>", " bad", "bad\r\nprefix"} {
+		m.BoundaryPrefix = prefix
+
+		var buffer bytes.Buffer
+		_, err = m.WriteTo(&buffer)
+		Expect(err).NotTo(BeNil(), "invalid boundary prefix %q accepted", prefix)
+		Expect(buffer.Len()).To(BeZero(), "message written despite invalid boundary prefix %q", prefix)
+		Expect(m.Validate()).To(Equal(err))
+	}
+}
+
+func TestDefaultFrom(t *testing.T) {
+	registerFailHandler(t)
+
+	defer func(from mail.Address) {
+		DefaultFrom = from
+	}(DefaultFrom)
+	DefaultFrom = mail.Address{Name: "Default Sender", Address: "default@domain.com"}
+
+	getFrom := func(m *Message) string {
+		b, err := m.Bytes()
+		expectNoError(err)
+
+		headerReader := textproto.NewReader(bufio.NewReader(bytes.NewReader(b)))
+		header, err := headerReader.ReadMIMEHeader()
+		expectNoError(err)
+		return header.Get("From")
+	}
+
+	m := &Message{}
+	m.AddTo("First person <to_1@domain.com>")
+	m.Body = "Test message"
+
+	expectNoError(m.Validate())
+	Expect(getFrom(m)).To(Equal(`"Default Sender" <default@domain.com>`), "default From not used")
+
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	Expect(getFrom(m)).To(Equal(`"Doman Sender" <sender@domain.com>`), "default From used instead of From")
+}
+
+func TestTestString(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.Subject = "My Subject"
+	m.Body = "Test message"
+
+	s, err := m.TestString(true)
+	expectNoError(err)
+
+	Expect(s).NotTo(ContainSubstring("\r"), "CRLF not normalized")
+	Expect(s).To(ContainSubstring("Subject: My Subject\n"))
+	Expect(s).To(ContainSubstring("Mime-Version: 1.0\n"))
+	Expect(s).To(ContainSubstring("\n\nTest message"))
+
+	s, err = m.TestString(false)
+	expectNoError(err)
+
+	Expect(s).To(ContainSubstring("Subject: My Subject\r\n"))
+}
+
+func TestResent(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.Subject = "My Subject"
+	m.Body = "Test message"
+	expectNoError(m.SetResent("Forwarder <forwarder@forward.com>", "Second person <to_2@domain.com>, to_3@domain.com"))
+
+	s, err := m.TestString(true)
+	expectNoError(err)
+
+	t.Logf("Message: \n%s", s)
+
+	lines := strings.Split(s, "\n")
+	Expect(lines[0]).To(HavePrefix("Resent-Date: "))
+	Expect(lines[1]).To(Equal(`Resent-From: "Forwarder" <forwarder@forward.com>`))
+	Expect(lines[2]).To(Equal(`Resent-To: "Second person" <to_2@domain.com>,`))
+	Expect(lines[3]).To(Equal(` <to_3@domain.com>`))
+	Expect(lines[4]).To(MatchRegexp(`^Resent-Message-ID: <[0-9a-f]+\.[0-9]+@forward\.com>$`))
+
+	msg, err := mail.ReadMessage(strings.NewReader(s))
+	expectNoError(err)
+	Expect(msg.Header.Get("From")).To(Equal(`"Doman Sender" <sender@domain.com>`))
+	Expect(msg.Header.Get("Subject")).To(Equal("My Subject"))
+}
+
+func TestAddressHelpers(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	expectNoError(m.SetFrom("Doman Sender <sender@domain.com>"))
+	expectNoError(m.AddTo("First person <to_1@domain.com>"))
+	expectNoError(m.AddCc("Copied person <cc_1@domain.com>"))
+	expectNoError(m.AddBcc("Hidden person <bcc_1@domain.com>"))
+	expectNoError(m.SetReplyTo("Reply person <reply@domain.com>"))
+	m.Body = "Test message"
+
+	Expect(m.AddCc("not an address")).NotTo(BeNil(), "malformed Cc address accepted")
+	Expect(m.AddBcc("not an address")).NotTo(BeNil(), "malformed Bcc address accepted")
+	Expect(m.SetReplyTo("not an address")).NotTo(BeNil(), "malformed Reply-To address accepted")
+	Expect(m.Cc).To(HaveLen(1))
+	Expect(m.Bcc).To(HaveLen(1))
+
+	b, err := m.Bytes()
+	expectNoError(err)
+
+	t.Logf("Bytes: \n%s", b)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	expectNoError(err)
+
+	Expect(msg.Header.Get("Cc")).To(Equal(`"Copied person" <cc_1@domain.com>`))
+	Expect(msg.Header.Get("Reply-To")).To(Equal(`"Reply person" <reply@domain.com>`))
+	Expect(msg.Header).NotTo(HaveKey("Bcc"), "Bcc header found")
+	Expect(string(b)).NotTo(ContainSubstring("bcc_1@domain.com"), "Bcc address found in message")
+}
+
+func TestAddressListHelpers(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	expectNoError(m.AddToList(`to_1@domain.com, "Doe, John" <to_2@domain.com>,Third person <to_3@domain.com>`))
+	expectNoError(m.AddCcList(`"Copied \"person\", the first" <cc_1@domain.com>`))
+	expectNoError(m.AddBccList("bcc_1@domain.com, bcc_2@domain.com"))
+
+	Expect(m.To).To(Equal([]mail.Address{
+		{Address: "to_1@domain.com"},
+		{Name: "Doe, John", Address: "to_2@domain.com"},
+		{Name: "Third person", Address: "to_3@domain.com"},
+	}))
+	Expect(m.Cc).To(Equal([]mail.Address{{Name: `Copied "person", the first`, Address: "cc_1@domain.com"}}))
+	Expect(m.Bcc).To(HaveLen(2))
+
+	Expect(m.AddToList(`to_4@domain.com, "Unterminated <to_5@domain.com>`)).NotTo(BeNil(), "malformed list accepted")
+	Expect(m.AddCcList("cc_2@domain.com, not an address")).NotTo(BeNil(), "malformed list accepted")
+	Expect(m.AddBccList("bcc_3@domain.com, <bcc_4@domain.com")).NotTo(BeNil(), "malformed list accepted")
+	Expect(m.To).To(HaveLen(3))
+	Expect(m.Cc).To(HaveLen(1))
+	Expect(m.Bcc).To(HaveLen(2))
+}
+
+func TestHeaderOrder(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.Subject = "My Subject"
+	m.Body = "Test message"
+	m.Headers = mail.Header{}
+	m.Headers["X-Custom"] = []string{"custom value"}
+	m.HeaderOrder = []string{"date", "From", "To", "Subject", "X-Missing"}
+
+	s, err := m.TestString(true)
+	expectNoError(err)
+
+	t.Logf("Message: \n%s", s)
+
+	var keys []string
+	for _, line := range strings.Split(strings.SplitN(s, "\n\n", 2)[0], "\n") {
+		if i := strings.Index(line, ":"); i > 0 && line[0] != ' ' {
+			keys = append(keys, line[:i])
+		}
+	}
+
+	Expect(keys).To(Equal([]string{
+		"Date",
+		"From",
+		"To",
+		"Subject",
+		"Content-Transfer-Encoding",
+		"Content-Type",
+		"Message-Id",
+		"Mime-Version",
+		"X-Custom",
+	}))
+}
+
+func TestEnsureRequiredHeaders(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.Body = "Test message"
+
+	added, err := m.EnsureRequiredHeaders()
+	expectNoError(err)
+	Expect(added).To(Equal([]string{"Date", "Message-ID", "MIME-Version"}))
+	Expect(m.Headers.Get("Message-ID")).To(MatchRegexp(`^<[0-9a-f]+\.[0-9]+@domain\.com>$`))
+	Expect(m.Headers.Get("MIME-Version")).To(Equal("1.0"))
+
+	added, err = m.EnsureRequiredHeaders()
+	expectNoError(err)
+	Expect(added).To(BeEmpty())
+
+	m.Headers = mail.Header{
+		"date":         []string{"Mon, 02 Jan 2006 15:04:05 +0000"},
+		"MIME-Version": []string{"1.0"},
+	}
+	added, err = m.EnsureRequiredHeaders()
+	expectNoError(err)
+	Expect(added).To(Equal([]string{"Message-ID"}))
+
+	b, err := m.Bytes()
+	expectNoError(err)
+
+	t.Logf("Message: \n%s", b)
+
+	Expect(strings.Count(strings.ToLower(string(b)), "\nmime-version:")).To(Equal(1))
+	Expect(strings.Count(strings.ToLower(string(b)), "\ndate:")).To(Equal(1))
+}
+
+func TestCharset(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Kovács Nándor <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.Subject = "Árvíztűrő tükörfúrógép"
+	m.Body = "Őrült győző"
+	m.HTMLBody = "<p>Őrült győző</p>"
+	m.Charset = "ISO-8859-2"
+
+	b, err := m.Bytes()
+	expectNoError(err)
+
+	t.Logf("Message: \n%s", b)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	expectNoError(err)
+
+	Expect(msg.Header.Get("Subject")).To(HavePrefix("=?ISO-8859-2?q?"))
+	Expect(msg.Header.Get("From")).To(HavePrefix("=?ISO-8859-2?q?"))
+
+	dec := &mime.WordDecoder{CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := ianaindex.MIME.Encoding(charset)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	}}
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	expectNoError(err)
+	Expect(subject).To(Equal(m.Subject))
+
+	from, err := (&mail.AddressParser{WordDecoder: dec}).Parse(msg.Header.Get("From"))
+	expectNoError(err)
+	Expect(from.Name).To(Equal("Kovács Nándor"))
+
+	root := parseMIME(b)
+	Expect(root.children).To(HaveLen(2))
+	for _, part := range root.children {
+		_, params := getContentType(part.header)
+		Expect(params["charset"]).To(Equal("ISO-8859-2"), part.mediaType)
+	}
+
+	Expect(string(root.children[0].body)).To(Equal("=D5r=FClt gy=F5z=F5"))
+	html, err := base64.StdEncoding.DecodeString(strings.Replace(string(root.children[1].body), crlf, "", -1))
+	expectNoError(err)
+	Expect(string(html)).To(Equal("<p>\xd5r\xfclt gy\xf5z\xf5</p>"))
+
+	// Long subjects are split into several encoded-words.
+	m.Subject = strings.Repeat("Árvíztűrő tükörfúrógép ", 5)
+	b, err = m.Bytes()
+	expectNoError(err)
+
+	msg, err = mail.ReadMessage(bytes.NewReader(b))
+	expectNoError(err)
+	words := strings.Fields(msg.Header.Get("Subject"))
+	Expect(len(words)).To(BeNumerically(">", 1), "long subject not split")
+	for _, word := range words {
+		Expect(word).To(HavePrefix("=?ISO-8859-2?q?"))
+		Expect(len(word)).To(BeNumerically("<=", 75), "encoded-word is too long")
+	}
+	subject, err = dec.DecodeHeader(msg.Header.Get("Subject"))
+	expectNoError(err)
+	Expect(subject).To(Equal(m.Subject))
+}
+
+func TestCharsetErrors(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("sender@domain.com")
+	m.AddTo("to_1@domain.com")
+	m.Body = "Price: 5 €"
+	m.Charset = "ISO-8859-2"
+
+	_, err := m.Bytes()
+	Expect(err).To(MatchError(ContainSubstring("'€' (U+20AC)")))
+
+	m.Body = "Test message"
+	m.Subject = "Ünnep 🎉"
+	_, err = m.Bytes()
+	Expect(err).To(MatchError(ContainSubstring("U+1F389")))
+
+	m.Subject = ""
+	m.Charset = "utf8"
+	_, err = m.Bytes()
+	expectNoError(err)
+
+	m.Charset = "no-such-charset"
+	_, err = m.Bytes()
+	Expect(err).To(MatchError(`Unknown charset "no-such-charset".`))
+	Expect(m.Validate()).To(MatchError(`Unknown charset "no-such-charset".`))
+}
+
+func TestAttachFile(t *testing.T) {
+	registerFailHandler(t)
+
+	dir, err := ioutil.TempDir("", "gophermail")
+	expectNoError(err)
+	defer os.RemoveAll(dir)
+
+	expectNoError(ioutil.WriteFile(filepath.Join(dir, "report.txt"), []byte("Test attachment"), 0644))
+	expectNoError(ioutil.WriteFile(filepath.Join(dir, "data.unknown-extension"), []byte{0, 1, 2}, 0644))
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.Body = "Test message"
+
+	expectNoError(m.AttachFile(filepath.Join(dir, "report.txt")))
+	expectNoError(m.AttachFile(filepath.Join(dir, "data.unknown-extension")))
+	Expect(m.AttachFile(filepath.Join(dir, "missing.txt"))).To(HaveOccurred())
+
+	Expect(m.Attachments).To(HaveLen(2))
+	Expect(m.Attachments[0].Name).To(Equal("report.txt"))
+	Expect(m.Attachments[0].ContentType).To(HavePrefix("text/plain"))
+	Expect(m.Attachments[1].Name).To(Equal("data.unknown-extension"))
+	Expect(m.Attachments[1].ContentType).To(Equal("application/octet-stream"))
+
+	// The files can go away, they have been read.
+	expectNoError(os.RemoveAll(dir))
+
+	s, err := m.TestString(false)
+	expectNoError(err)
+	Expect(s).To(ContainSubstring(base64.StdEncoding.EncodeToString([]byte("Test attachment"))))
+	Expect(s).To(ContainSubstring(base64.StdEncoding.EncodeToString([]byte{0, 1, 2})))
+
+	s, err = m.TestString(false)
+	expectNoError(err)
+	Expect(s).To(ContainSubstring(base64.StdEncoding.EncodeToString([]byte("Test attachment"))))
+}
+
+func TestEmptyBody(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.Subject = "Ping"
+	m.Charset = "ISO-8859-2"
+
+	b, err := m.Bytes()
+	expectNoError(err)
+
+	t.Logf("Bytes: \n%s", b)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	expectNoError(err)
+	Expect(msg.Header.Get("Subject")).To(Equal("Ping"))
+	Expect(msg.Header.Get("Content-Type")).To(Equal("text/plain; charset=us-ascii"))
+	Expect(msg.Header.Get("Content-Transfer-Encoding")).To(Equal("7bit"))
+
+	body, err := ioutil.ReadAll(msg.Body)
+	expectNoError(err)
+	Expect(strings.TrimSpace(string(body))).To(BeEmpty())
+}
+
+func TestAutoMessageID(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.Body = "Test message"
+
+	seen := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		b, err := m.Bytes()
+		expectNoError(err)
+
+		msg, err := mail.ReadMessage(bytes.NewReader(b))
+		expectNoError(err)
+		Expect(msg.Header["Message-Id"]).To(HaveLen(1))
+
+		messageID := msg.Header.Get("Message-Id")
+		Expect(messageID).To(MatchRegexp(`^<[0-9a-f]{32}\.[0-9]+@domain\.com>$`))
+		Expect(seen).NotTo(HaveKey(messageID), "Message-ID is not unique")
+		seen[messageID] = true
+	}
+
+	m.MessageIDDomain = "mail.example.com"
+	b, err := m.Bytes()
+	expectNoError(err)
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	expectNoError(err)
+	Expect(msg.Header.Get("Message-Id")).To(HaveSuffix("@mail.example.com>"))
+
+	hostname, err := os.Hostname()
+	expectNoError(err)
+	m.MessageIDDomain = ""
+	m.From = mail.Address{Address: "sender"}
+	b, err = m.Bytes()
+	expectNoError(err)
+	msg, err = mail.ReadMessage(bytes.NewReader(b))
+	expectNoError(err)
+	Expect(msg.Header.Get("Message-Id")).To(HaveSuffix("@" + hostname + ">"))
+
+	m.Headers = mail.Header{"message-id": []string{"<custom@domain.com>"}}
+	s, err := m.TestString(false)
+	expectNoError(err)
+	Expect(strings.Count(strings.ToLower(s), "message-id:")).To(Equal(1))
+	Expect(s).To(ContainSubstring("message-id: <custom@domain.com>"))
+
+	m.Headers = nil
+	for _, domain := range []string{
+		"domain.com>",
+		"mail..domain.com",
+		"mail domain.com",
+	} {
+		m.MessageIDDomain = domain
+		_, err = m.Bytes()
+		Expect(err).To(MatchError(fmt.Sprintf("Message-ID domain %q is not a valid domain.", domain)))
+		Expect(m.ValidateAll()).To(ContainElement(err))
+		_, err = m.EnsureRequiredHeaders()
+		Expect(err).NotTo(BeNil(), "invalid Message-ID domain %q accepted", domain)
+	}
+}
+
+func TestAddressGroups(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	expectNoError(m.AddToGroup("Team", "a@domain.com", "Second person <b@domain.com>"))
+	expectNoError(m.AddCcGroup("Undisclosed recipients"))
+	expectNoError(m.AddCcGroup("Ügyfelek, partnerek", "c@domain.com"))
+	Expect(m.AddToGroup("Broken", "d@domain.com", "not an address")).To(HaveOccurred())
+	Expect(m.ToGroups).To(HaveLen(1))
+	m.Body = "Test message"
+
+	b, err := m.Bytes()
+	expectNoError(err)
+
+	t.Logf("Bytes: \n%s", b)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	expectNoError(err)
+
+	Expect(msg.Header.Get("To")).To(ContainSubstring("Team:"))
+	to, err := mail.ParseAddressList(msg.Header.Get("To"))
+	expectNoError(err)
+	Expect(to).To(Equal([]*mail.Address{
+		{Name: "First person", Address: "to_1@domain.com"},
+		{Address: "a@domain.com"},
+		{Name: "Second person", Address: "b@domain.com"},
+	}))
+
+	Expect(msg.Header.Get("Cc")).To(HavePrefix("Undisclosed recipients:;"))
+	cc, err := mail.ParseAddressList(msg.Header.Get("Cc"))
+	expectNoError(err)
+	Expect(cc).To(Equal([]*mail.Address{{Address: "c@domain.com"}}))
+
+	from, to2 := envelope(m)
+	Expect(from).To(Equal("sender@domain.com"))
+	Expect(to2).To(Equal([]string{"to_1@domain.com", "a@domain.com", "b@domain.com", "c@domain.com"}))
+}
+
+func TestAddressGroupName(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	Expect(m.AddToGroup("", "a@domain.com")).To(Equal(ErrEmptyGroupName))
+	Expect(m.AddCcGroup("", "a@domain.com")).To(Equal(ErrEmptyGroupName))
+	Expect(m.ToGroups).To(BeEmpty())
+	Expect(m.CcGroups).To(BeEmpty())
+
+	m.ToGroups = []AddressGroup{{Addresses: []mail.Address{{Address: "a@domain.com"}}}}
+	Expect(m.ValidateAll()).To(ContainElement(ErrEmptyGroupName))
+	_, err := m.Bytes()
+	Expect(err).To(Equal(ErrEmptyGroupName))
+
+	for _, test := range []struct {
+		name     string
+		expected string
+	}{
+		{"Team", "Team:"},
+		{"Team, \"ops\"", `"Team, \"ops\"":`},
+		{"Back\\slash", `"Back\\slash":`},
+		{"Ügyfelek", "=?utf-8?q?=C3=9Cgyfelek?=:"},
+		{"Ügyfelek, partnerek", "=?utf-8?b?w5xneWZlbGVrLCBwYXJ0bmVyZWs=?=:"},
+	} {
+		m.ToGroups = nil
+		expectNoError(m.AddToGroup(test.name, "a@domain.com"))
+
+		b, err := m.Bytes()
+		expectNoError(err)
+
+		msg, err := mail.ReadMessage(bytes.NewReader(b))
+		expectNoError(err)
+		Expect(msg.Header.Get("To")).To(HavePrefix(test.expected))
+		to, err := mail.ParseAddressList(msg.Header.Get("To"))
+		expectNoError(err)
+		Expect(to).To(Equal([]*mail.Address{{Address: "a@domain.com"}}))
+	}
+}
+
+func TestEmptyAddressGroup(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	expectNoError(m.AddToGroup("Undisclosed recipients"))
+	m.Body = "Test message"
+
+	Expect(m.ValidateAll()).To(ContainElement(ErrMissingRecipient))
+	_, err := m.Bytes()
+	Expect(err).To(Equal(ErrMissingRecipient))
+	_, err = m.WriteTo(io.Discard)
+	Expect(err).To(Equal(ErrMissingRecipient))
+
+	server := newFakeSMTPServer(t)
+	Expect(SendMail(server.Addr(), nil, m)).To(Equal(ErrMissingRecipient))
+	Expect(server.Count("MAIL")).To(Equal(0))
+
+	m.AddBcc("bcc_1@domain.com")
+	Expect(m.ValidateAll()).To(BeEmpty())
+	b, err := m.Bytes()
+	expectNoError(err)
+	Expect(string(b)).To(ContainSubstring("To: Undisclosed recipients:;\r\n"))
+}
+
+func TestWriteTo(t *testing.T) {
+	registerFailHandler(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	expectNoError(err)
+
+	for _, test := range []struct {
+		description string
+		configure   func(m *Message)
+	}{
+		{"plain", func(m *Message) {}},
+		{"html", func(m *Message) {
+			m.HTMLBody = "<p>Test message</p>"
+		}},
+		{"attachments", func(m *Message) {
+			m.HTMLBody = `<p>Test message</p><img src="cid:logo.png">`
+			m.InlineImages = []Attachment{{Name: "logo.png", Data: strings.NewReader("\x89PNG fake image data")}}
+			m.Attachments = []Attachment{
+				{Name: "test.txt", Data: strings.NewReader(strings.Repeat("Test attachment\n", 1000))},
+				{Name: "test.csv", Data: strings.NewReader("a,b\n1,2\n"), Encoding: EncodingAuto},
+			}
+		}},
+		{"resent", func(m *Message) {
+			m.SetResent("Resender <resender@domain.com>", "to_2@domain.com")
+		}},
+		{"dkim", func(m *Message) {
+			m.Attachments = []Attachment{{Name: "test.txt", Data: strings.NewReader("Test attachment")}}
+			m.DKIM = &DKIMOptions{
+				PrivateKey: key,
+				Selector:   "default",
+				Domain:     "domain.com",
+				Time:       time.Unix(1700000000, 0),
+			}
+		}},
+	} {
+		newMessage := func() *Message {
+			m := &Message{}
+			m.SetFrom("Doman Sender <sender@domain.com>")
+			m.AddTo("First person <to_1@domain.com>")
+			m.Subject = "My Subject"
+			m.Body = "Test message"
+			m.Boundary = "test-boundary"
+			m.Headers = mail.Header{
+				"Date":       []string{"Mon, 02 Jan 2006 15:04:05 +0000"},
+				"Message-Id": []string{"<test@domain.com>"},
+			}
+			test.configure(m)
+			return m
+		}
+
+		expected, err := newMessage().Bytes()
+		expectNoError(err)
+
+		var buffer bytes.Buffer
+		n, err := newMessage().WriteTo(&buffer)
+		expectNoError(err)
+		Expect(n).To(Equal(int64(buffer.Len())), test.description)
+
+		if test.description == "resent" {
+			// The Resent-Date and Resent-Message-ID differ.
+			resent := regexp.MustCompile(`Resent-(Date|Message-ID): [^\r]*`)
+			expected = resent.ReplaceAll(expected, nil)
+			Expect(resent.ReplaceAll(buffer.Bytes(), nil)).To(Equal(expected), test.description)
+			continue
+		}
+		Expect(buffer.String()).To(Equal(string(expected)), test.description)
+	}
+}
+
+// TestWriteToGolden compares the output of WriteTo with the output of
+// Bytes from before it was built on WriteTo, which is kept in testdata.
+func TestWriteToGolden(t *testing.T) {
+	registerFailHandler(t)
+
+	block, _ := pem.Decode([]byte(dkimTestKey))
+	Expect(block).NotTo(BeNil(), "invalid test key")
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	expectNoError(err)
+
+	binary := make([]byte, 256)
+	for i := range binary {
+		binary[i] = byte(i)
+	}
+
+	for _, test := range []struct {
+		golden    string
+		configure func(m *Message)
+	}{
+		{"writeto_attachments.eml", func(m *Message) {
+			m.Body = "Test message"
+			m.Attachments = []Attachment{
+				{Name: "test.txt", ContentType: "text/plain", Data: strings.NewReader(strings.Repeat("Test attachment\n", 10))},
+				{Name: "data.bin", ContentType: "application/octet-stream", Data: bytes.NewReader(binary)},
+			}
+		}},
+		{"writeto_inline.eml", func(m *Message) {
+			m.HTMLBody = `<p>Test message</p><img src="cid:logo.png">`
+			m.InlineImages = []Attachment{{Name: "logo.png", ContentType: "image/png", Data: strings.NewReader("\x89PNG fake image data")}}
+		}},
+		{"writeto_dkim.eml", func(m *Message) {
+			m.Body = "Test message"
+			m.Attachments = []Attachment{{Name: "test.txt", ContentType: "text/plain", Data: strings.NewReader("Test attachment")}}
+			m.DKIM = &DKIMOptions{
+				PrivateKey: key,
+				Selector:   "default",
+				Domain:     "domain.com",
+				Time:       time.Unix(1700000000, 0),
+			}
+		}},
+	} {
+		expected, err := ioutil.ReadFile(filepath.Join("testdata", test.golden))
+		expectNoError(err)
+
+		m := &Message{}
+		m.SetFrom("Doman Sender <sender@domain.com>")
+		m.AddTo("First person <to_1@domain.com>")
+		m.Subject = "My Subject"
+		m.Boundary = "golden"
+		m.Headers = mail.Header{
+			"Date":       []string{"Mon, 02 Jan 2006 15:04:05 +0000"},
+			"Message-Id": []string{"<golden@domain.com>"},
+		}
+		test.configure(m)
+
+		var buffer bytes.Buffer
+		n, err := m.WriteTo(&buffer)
+		expectNoError(err)
+		Expect(n).To(Equal(int64(len(expected))), test.golden)
+		Expect(buffer.String()).To(Equal(string(expected)), test.golden)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	registerFailHandler(t)
+
+	for _, test := range []struct {
+		priority    Priority
+		headers     mail.Header
+		expected    map[string]string
+		description string
+	}{
+		{PriorityNormal, nil, map[string]string{}, "normal"},
+		{PriorityHigh, nil, map[string]string{
+			"X-Priority":        "1",
+			"X-MSMail-Priority": "High",
+			"Importance":        "high",
+		}, "high"},
+		{PriorityLow, nil, map[string]string{
+			"X-Priority":        "5",
+			"X-MSMail-Priority": "Low",
+			"Importance":        "low",
+		}, "low"},
+		{PriorityHigh, mail.Header{"importance": []string{"normal"}}, map[string]string{
+			"X-Priority":        "1",
+			"X-MSMail-Priority": "High",
+			"importance":        "normal",
+		}, "user header"},
+	} {
+		m := &Message{}
+		m.SetFrom("Doman Sender <sender@domain.com>")
+		m.AddTo("First person <to_1@domain.com>")
+		m.Body = "Test message"
+		m.Priority = test.priority
+		m.Headers = test.headers
+
+		s, err := m.TestString(false)
+		expectNoError(err)
+
+		found := map[string]string{}
+		for _, line := range strings.Split(strings.SplitN(s, crlf+crlf, 2)[0], crlf) {
+			kv := strings.SplitN(line, ": ", 2)
+			switch strings.ToLower(kv[0]) {
+			case "x-priority", "x-msmail-priority", "importance":
+				Expect(found).NotTo(HaveKey(kv[0]), test.description)
+				found[kv[0]] = kv[1]
+			}
+		}
+		Expect(found).To(Equal(test.expected), test.description)
+	}
+}
+
+func TestHeaderWhitespace(t *testing.T) {
+	registerFailHandler(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	expectNoError(err)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>", "Second person <to_2@domain.com>")
+	m.AddCcGroup("Team", "cc_1@domain.com", "cc_2@domain.com")
+	m.SetResent("Resender <resender@domain.com>", "to_3@domain.com")
+	m.Subject = "  My Subject  "
+	m.Body = "Test message"
+	m.HTMLBody = "<p>Test message</p>"
+	m.Attachments = []Attachment{{
+		Name: "test.txt",
+		Data: strings.NewReader("Test attachment"),
+	}}
+	m.Headers = mail.Header{
+		"X-Padded": []string{"\t padded value \t"},
+		"X-Empty":  []string{""},
+	}
+	m.DKIM = &DKIMOptions{
+		PrivateKey: key,
+		Selector:   "default",
+		Domain:     "domain.com",
+	}
+
+	s, err := m.TestString(false)
+	expectNoError(err)
+
+	t.Logf("Message: \n%s", s)
+
+	field := regexp.MustCompile(`^[!-9;-~]+(: \S.*|:)$`)
+	inHeader := true
+	headers := 0
+	for _, line := range strings.Split(s, crlf) {
+		switch {
+		case strings.HasPrefix(line, "--"):
+			// Each part has a header.
+			inHeader = true
+		case line == "":
+			inHeader = false
+		case inHeader:
+			Expect(line).NotTo(MatchRegexp(`[ \t]$`), "trailing whitespace")
+			if line[0] != ' ' && line[0] != '\t' {
+				Expect(line).To(MatchRegexp(field.String()), "not formatted as \"Key: value\"")
+				headers++
+			}
+		}
+	}
+	Expect(headers).To(BeNumerically(">", 20))
+
+	Expect(s).To(ContainSubstring(crlf + "Subject: My Subject" + crlf))
+	Expect(s).To(ContainSubstring(crlf + "X-Padded: padded value" + crlf))
+	Expect(s).To(ContainSubstring(crlf + "X-Empty:" + crlf))
+}
@@ -0,0 +1,644 @@
+package gophermail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+
+	"github.com/sloonz/go-qprintable"
+)
+
+// A mimePart is a node of the MIME tree built by Bytes.
+//
+// The tree for a message with every kind of content looks like this:
+//
+//	multipart/mixed
+//		multipart/alternative
+//			text/plain
+//			text/watch-html
+//			multipart/related
+//				text/html
+//				inline images
+//			text/calendar
+//		attachments
+//
+// Containers with a single child are left out.
+type mimePart struct {
+	header textproto.MIMEHeader
+
+	// writeBody writes the encoded body of the part.
+	writeBody func(w io.Writer) error
+
+	// subtype and children are set for multipart containers.
+	// Their header and writeBody are set by setBoundaries.
+	subtype  string
+	children []*mimePart
+}
+
+// isMultipart reports whether the part is a multipart container.
+func (p *mimePart) isMultipart() bool {
+	return p.subtype != ""
+}
+
+// nestedBoundaryPrefixes are prepended to Message.Boundary to derive
+// the boundaries of nested containers. Suffixes would make the outer
+// delimiter a prefix of the inner ones, which RFC 2046 doesn't allow.
+var nestedBoundaryPrefixes = map[string]string{
+	"mixed":       "mix_",
+	"alternative": "alt_",
+	"related":     "rel_",
+}
+
+// maxNestedBoundaryPrefixLength is the length of the longest
+// nested boundary prefix.
+const maxNestedBoundaryPrefixLength = 4
+
+// bodyPart builds the MIME tree of the message.
+// Its text parts are encoded in charset cs.
+func (m *Message) bodyPart(cs *charset) (*mimePart, error) {
+	var alternatives []*mimePart
+
+	if m.Body != "" {
+		plain, err := plainPart(m.Body, cs)
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, plain)
+	}
+
+	// Apple Watch expects text/watch-html after text/plain and before text/html.
+	if m.WatchHTMLBody != "" {
+		watch, err := base64TextPart("text/watch-html", m.WatchHTMLBody, cs)
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, watch)
+	}
+
+	if m.HTMLBody != "" {
+		html, err := m.htmlPart(cs)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(m.InlineImages) > 0 {
+			parts := []*mimePart{html}
+			for _, image := range m.InlineImages {
+				inline, err := inlinePart(image)
+				if err != nil {
+					return nil, err
+				}
+				parts = append(parts, inline)
+			}
+			html = multipartPart("related", parts...)
+		}
+
+		alternatives = append(alternatives, html)
+	} else if len(m.InlineImages) > 0 {
+		return nil, ErrInlineImagesWithoutHTMLBody
+	}
+
+	// Calendar clients look for the invitation after the text bodies.
+	if m.Calendar != "" {
+		calendar, err := m.calendarPart()
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, calendar)
+	}
+
+	// Only include an empty plain text body if there is nothing else.
+	if len(alternatives) == 0 {
+		alternatives = append(alternatives, emptyPart())
+	}
+
+	body := alternatives[0]
+	if len(alternatives) > 1 {
+		body = multipartPart("alternative", alternatives...)
+	}
+
+	if len(m.Attachments) > 0 {
+		parts := []*mimePart{body}
+		for _, attachment := range m.Attachments {
+			part, err := attachmentPart(attachment)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+		}
+		body = multipartPart("mixed", parts...)
+	}
+
+	err := m.setBoundaries(body, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// multipartPart creates a multipart/subtype container of parts.
+func multipartPart(subtype string, parts ...*mimePart) *mimePart {
+	return &mimePart{subtype: subtype, children: parts}
+}
+
+// setBoundaries chooses the boundaries of part and the multipart
+// containers inside it, and sets up their headers and writeBody.
+//
+// If the message has a Boundary, the top level container uses it,
+// and nested containers prepend a prefix to it. Otherwise the
+// boundaries are random.
+func (m *Message) setBoundaries(part *mimePart, toplevel bool) error {
+	if !part.isMultipart() {
+		return nil
+	}
+
+	var boundary string
+	if m.Boundary != "" {
+		boundary = m.Boundary
+		if !toplevel {
+			boundary = nestedBoundaryPrefixes[part.subtype] + boundary
+		}
+	} else {
+		var err error
+		boundary, err = randomBoundary(m.BoundaryPrefix)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, child := range part.children {
+		err := m.setBoundaries(child, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	subtype, parts := part.subtype, part.children
+	header := textproto.MIMEHeader{}
+	header.Add("Content-Type", fmt.Sprintf("multipart/%s;%s boundary=%s", subtype, crlf, boundaryParam(boundary)))
+
+	writeBody := func(w io.Writer) error {
+		mw := multipart.NewWriter(w)
+		err := mw.SetBoundary(boundary)
+		if err != nil {
+			return err
+		}
+
+		for _, part := range parts {
+			partw, err := mw.CreatePart(part.header)
+			if err != nil {
+				return err
+			}
+			err = part.writeBody(partw)
+			if err != nil {
+				return err
+			}
+		}
+
+		return mw.Close()
+	}
+
+	part.header = header
+	part.writeBody = writeBody
+	return nil
+}
+
+// plainPart creates a quoted-printable text/plain part
+// with text encoded in charset cs.
+func plainPart(text string, cs *charset) (*mimePart, error) {
+	text, err := cs.encode(text)
+	if err != nil {
+		return nil, err
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Add("Content-Type", "text/plain; charset="+cs.name)
+	header.Add("Content-Transfer-Encoding", "quoted-printable")
+
+	writeBody := func(w io.Writer) error {
+		encoder := qprintable.NewEncoder(qprintable.DetectEncoding(text), w)
+		_, err := io.WriteString(encoder, text)
+		if err != nil {
+			return err
+		}
+		return encoder.Close()
+	}
+
+	return &mimePart{header: header, writeBody: writeBody}, nil
+}
+
+// emptyPart creates the empty text/plain part of a message without a body.
+func emptyPart() *mimePart {
+	header := textproto.MIMEHeader{}
+	header.Add("Content-Type", "text/plain; charset=us-ascii")
+	header.Add("Content-Transfer-Encoding", "7bit")
+
+	writeBody := func(w io.Writer) error {
+		return nil
+	}
+
+	return &mimePart{header: header, writeBody: writeBody}
+}
+
+// htmlPart creates the text/html part of the message.
+func (m *Message) htmlPart(cs *charset) (*mimePart, error) {
+	htmlBody := m.HTMLBody
+	if m.CSSInliner != nil {
+		var err error
+		htmlBody, err = m.CSSInliner.InlineCSS(htmlBody)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return base64TextPart("text/html", htmlBody, cs)
+}
+
+// defaultCalendarMethod is used when Message.CalendarMethod isn't set.
+const defaultCalendarMethod = "REQUEST"
+
+// calendarPart creates the text/calendar part of the message.
+// iCalendar objects are always UTF-8.
+func (m *Message) calendarPart() (*mimePart, error) {
+	method := m.CalendarMethod
+	if method == "" {
+		method = defaultCalendarMethod
+	}
+	err := validateCalendarMethod(method)
+	if err != nil {
+		return nil, err
+	}
+
+	part, err := base64TextPart("text/calendar", m.Calendar, &charset{name: defaultCharset})
+	if err != nil {
+		return nil, err
+	}
+	part.header.Set("Content-Type", fmt.Sprintf("text/calendar; method=%s; charset=%s", method, defaultCharset))
+	return part, nil
+}
+
+// validateCalendarMethod checks that an iTIP method is a valid
+// iCalendar name, e.g. "REQUEST" or "X-CUSTOM".
+func validateCalendarMethod(method string) error {
+	for _, c := range method {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-':
+		default:
+			return fmt.Errorf("Calendar method %q contains invalid character %q.", method, c)
+		}
+	}
+	return nil
+}
+
+// base64TextPart creates a base64 encoded text part
+// with text encoded in charset cs.
+func base64TextPart(mediaType, text string, cs *charset) (*mimePart, error) {
+	text, err := cs.encode(text)
+	if err != nil {
+		return nil, err
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Add("Content-Type", mediaType+"; charset="+cs.name)
+	header.Add("Content-Transfer-Encoding", "base64")
+
+	writeBody := func(w io.Writer) error {
+		encoder := NewBase64MimeEncoder(w)
+		_, err := io.WriteString(encoder, text)
+		if err != nil {
+			return err
+		}
+		return encoder.Close()
+	}
+
+	return &mimePart{header: header, writeBody: writeBody}, nil
+}
+
+// attachmentPart creates the part of a regular attachment.
+func attachmentPart(attachment Attachment) (*mimePart, error) {
+	return fileAttachmentPart(attachment, "attachment")
+}
+
+// inlinePart creates the part of an inline image.
+// Its Content-ID is its name, so that the HTML body can refer to it.
+func inlinePart(image Attachment) (*mimePart, error) {
+	part, err := fileAttachmentPart(image, "inline")
+	if err != nil {
+		return nil, err
+	}
+	part.header.Add("Content-Id", "<"+strings.Trim(image.Name, "<>")+">")
+	return part, nil
+}
+
+// fileAttachmentPart creates the part for an attachment
+// with the given Content-Disposition.
+func fileAttachmentPart(attachment Attachment, disposition string) (*mimePart, error) {
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(attachment.Name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+	}
+
+	isText := strings.HasPrefix(strings.ToLower(contentType), "text/")
+
+	if attachment.FilenameParams != FilenameDisposition {
+		contentType = fmt.Sprintf(`%s;%s name="%s"`, contentType, crlf, attachment.Name)
+	}
+	if attachment.FilenameParams != FilenameContentType {
+		disposition = fmt.Sprintf(`%s;%s filename="%s"`, disposition, crlf, attachment.Name)
+	}
+
+	data, qpEncoding, err := transferEncoding(attachment, isText)
+	if err != nil {
+		return nil, err
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Add("Content-Type", contentType)
+	header.Add("Content-Disposition", disposition)
+	if qpEncoding != nil {
+		header.Add("Content-Transfer-Encoding", "quoted-printable")
+	} else {
+		header.Add("Content-Transfer-Encoding", "base64")
+	}
+
+	writeBody := func(w io.Writer) error {
+		if data == nil {
+			return nil
+		}
+
+		var encoder io.WriteCloser
+		if qpEncoding != nil {
+			encoder = qprintable.NewEncoder(qpEncoding, w)
+		} else {
+			encoder = NewBase64MimeEncoder(w)
+		}
+		_, err := io.Copy(encoder, data)
+		if err != nil {
+			return err
+		}
+		return encoder.Close()
+	}
+
+	return &mimePart{header: header, writeBody: writeBody}, nil
+}
+
+// bufferAttachments applies the message's BufferThreshold
+// to the Data of its attachments and inline images.
+func (m *Message) bufferAttachments() error {
+	if m.BufferThreshold <= 0 {
+		return nil
+	}
+
+	for _, attachments := range [][]Attachment{m.Attachments, m.InlineImages} {
+		for i := range attachments {
+			err := bufferAttachment(&attachments[i], m.BufferThreshold)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// bufferAttachment replaces the Data of an attachment with a bufferedData
+// if it is shorter than threshold, or with a streamedData otherwise.
+func bufferAttachment(attachment *Attachment, threshold int64) error {
+	switch attachment.Data.(type) {
+	case nil, *bufferedData, *streamedData:
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	_, err := io.CopyN(buf, attachment.Data, threshold)
+	if err == io.EOF {
+		attachment.Data = &bufferedData{data: buf.Bytes()}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	attachment.Data = &streamedData{r: io.MultiReader(buf, attachment.Data)}
+	return nil
+}
+
+// bufferedData is attachment Data that was read into memory.
+type bufferedData struct {
+	data []byte
+	r    *bytes.Reader
+}
+
+func (d *bufferedData) Read(p []byte) (int, error) {
+	if d.r == nil {
+		d.r = bytes.NewReader(d.data)
+	}
+	return d.r.Read(p)
+}
+
+// streamedData is attachment Data that is too long to buffer.
+type streamedData struct {
+	r    io.Reader
+	used bool
+}
+
+func (d *streamedData) Read(p []byte) (int, error) {
+	return d.r.Read(p)
+}
+
+// attachmentData returns a reader for the Data of an attachment.
+// Buffered Data is read from the start every time.
+// Errors reading the Data are returned as attachmentErrors.
+func attachmentData(attachment Attachment) (io.Reader, error) {
+	switch data := attachment.Data.(type) {
+	case nil:
+		return nil, nil
+	case *bufferedData:
+		return bytes.NewReader(data.data), nil
+	case *streamedData:
+		if data.used {
+			return nil, ErrAttachmentStreamed
+		}
+		data.used = true
+		return &attachmentReader{r: data.r}, nil
+	}
+	return &attachmentReader{r: attachment.Data}, nil
+}
+
+// An attachmentError is an error reading the Data of an attachment,
+// as opposed to an error writing the message, e.g. to the network.
+type attachmentError struct {
+	err error
+}
+
+func (e *attachmentError) Error() string {
+	return e.err.Error()
+}
+
+// unwrapAttachmentError returns the original error
+// if err is an attachmentError, and err otherwise.
+func unwrapAttachmentError(err error) error {
+	if e, ok := err.(*attachmentError); ok {
+		return e.err
+	}
+	return err
+}
+
+// attachmentReader wraps the errors of reading attachment Data
+// in attachmentErrors.
+type attachmentReader struct {
+	r io.Reader
+}
+
+func (r *attachmentReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &attachmentError{err: err}
+	}
+	return n, err
+}
+
+// sniffLength is how much of an attachment is looked at
+// to choose its transfer encoding.
+const sniffLength = 512
+
+// transferEncoding chooses the transfer encoding of an attachment.
+// It returns the quoted-printable encoding to use, or nil for base64.
+// isText reports whether the attachment has a text/* content type.
+//
+// Choosing may read the start of the attachment's Data, so the
+// returned reader must be used instead; it replays what was read.
+func transferEncoding(attachment Attachment, isText bool) (io.Reader, *qprintable.Encoding, error) {
+	data, err := attachmentData(attachment)
+	if err != nil {
+		return nil, nil, err
+	}
+	if attachment.Encoding == EncodingBase64 || data == nil {
+		return data, nil, nil
+	}
+
+	start := make([]byte, sniffLength)
+	n, err := io.ReadFull(data, start)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, nil, err
+	}
+	start = start[:n]
+	data = io.MultiReader(bytes.NewReader(start), data)
+
+	mostlyText := isMostlyText(start)
+	if !mostlyText && attachment.Encoding == EncodingAuto {
+		return data, nil, nil
+	}
+
+	// Text mode converts every line break to CRLF, which is only right
+	// for text. Data that merely starts like text, e.g. a PDF, can
+	// have binary bytes further on, so anything else is encoded in
+	// binary mode, where line breaks are encoded and survive unchanged.
+	if !isText || !mostlyText {
+		return data, qprintable.BinaryEncoding, nil
+	}
+
+	return data, qprintable.DetectEncoding(string(start)), nil
+}
+
+// isMostlyText reports whether b looks like text, i.e. it has no NUL
+// bytes, and at least 90% of it is printable ASCII or whitespace.
+func isMostlyText(b []byte) bool {
+	printable := 0
+	for _, c := range b {
+		switch {
+		case c == 0:
+			return false
+		case c == '\t', c == '\r', c == '\n', ' ' <= c && c <= '~':
+			printable++
+		}
+	}
+	return printable*10 >= len(b)*9
+}
+
+// validateBoundary checks that a Message.Boundary, including the prefixes
+// of nested containers, only uses characters allowed by RFC 2046 and
+// isn't too long, and that it isn't a prefix of a nested boundary.
+func validateBoundary(boundary string) error {
+	if len(boundary)+maxNestedBoundaryPrefixLength > maxBoundaryLength {
+		return fmt.Errorf("Boundary %q is longer than %d characters.", boundary, maxBoundaryLength-maxNestedBoundaryPrefixLength)
+	}
+
+	if c, ok := invalidBoundaryChar(boundary); ok {
+		return fmt.Errorf("Boundary %q contains invalid character %q.", boundary, c)
+	}
+
+	// The top level boundary is used as is, so it can't end with a space.
+	if strings.HasSuffix(boundary, " ") {
+		return fmt.Errorf("Boundary %q ends with a space.", boundary)
+	}
+
+	// Only a boundary that repeats a prefix, e.g. "alt_alt_",
+	// can be a prefix of the nested boundary derived from it.
+	for _, prefix := range nestedBoundaryPrefixes {
+		if strings.HasPrefix(prefix+boundary, boundary) {
+			return fmt.Errorf("Boundary %q is a prefix of the nested boundary %q.", boundary, prefix+boundary)
+		}
+	}
+
+	return nil
+}
+
+// validateBoundaryPrefix checks that a Message.BoundaryPrefix only uses
+// characters allowed by RFC 2046 and isn't too long.
+func validateBoundaryPrefix(prefix string) error {
+	if len(prefix) > maxBoundaryPrefixLength {
+		return ErrBoundaryPrefixTooLong
+	}
+
+	if c, ok := invalidBoundaryChar(prefix); ok {
+		return fmt.Errorf("Boundary prefix %q contains invalid character %q.", prefix, c)
+	}
+
+	return nil
+}
+
+// invalidBoundaryChar returns the first character of s
+// that isn't allowed in a boundary by RFC 2046.
+func invalidBoundaryChar(s string) (rune, bool) {
+	for i, c := range s {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		case strings.ContainsRune("'()+_,-./:=?", c):
+		case c == ' ' && i > 0:
+			// Spaces are allowed, just not at the ends. Trailing
+			// spaces are checked by the callers: a prefix can end
+			// with one, since random characters follow it.
+		default:
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// randomBoundary generates a random multipart boundary starting with prefix,
+// which must have been checked with validateBoundaryPrefix.
+func randomBoundary(prefix string) (string, error) {
+	// Same as multipart.Writer's boundaries.
+	var random [30]byte
+	_, err := rand.Read(random[:])
+	if err != nil {
+		return "", err
+	}
+
+	boundary := prefix + hex.EncodeToString(random[:])
+	if len(boundary) > maxBoundaryLength {
+		boundary = boundary[:maxBoundaryLength]
+	}
+	return boundary, nil
+}
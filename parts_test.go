@@ -0,0 +1,525 @@
+package gophermail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+// mimeNode is a parsed MIME part, used to check the structure of messages.
+type mimeNode struct {
+	mediaType string
+	header    textproto.MIMEHeader
+	body      []byte
+	children  []*mimeNode
+}
+
+// parseMIME parses the MIME tree of a message.
+func parseMIME(b []byte) *mimeNode {
+	reader := bufio.NewReader(bytes.NewReader(b))
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	expectNoError(err)
+
+	return parseMIMEPart(header, reader)
+}
+
+func parseMIMEPart(header textproto.MIMEHeader, r io.Reader) *mimeNode {
+	mediaType, params := getContentType(header)
+	node := &mimeNode{mediaType: mediaType, header: header}
+
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		body, err := ioutil.ReadAll(r)
+		expectNoError(err)
+		node.body = body
+		return node
+	}
+
+	multipartReader := multipart.NewReader(r, params["boundary"])
+	for {
+		part, err := multipartReader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		expectNoError(err)
+		node.children = append(node.children, parseMIMEPart(part.Header, part))
+	}
+	return node
+}
+
+// mediaTypes returns the media types of the children of a node.
+func (n *mimeNode) mediaTypes() []string {
+	var types []string
+	for _, child := range n.children {
+		types = append(types, child.mediaType)
+	}
+	return types
+}
+
+func TestInlineImages(t *testing.T) {
+	registerFailHandler(t)
+
+	imageData := "\x89PNG fake image data"
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.Body = "Test message"
+	m.HTMLBody = `<p>Test message</p><img src="cid:logo.png">`
+	m.InlineImages = []Attachment{{
+		Name: "logo.png",
+		Data: strings.NewReader(imageData),
+	}}
+	m.Attachments = []Attachment{{
+		Name: "test.txt",
+		Data: strings.NewReader("Test attachment"),
+	}}
+
+	b, err := m.Bytes()
+	expectNoError(err)
+
+	t.Logf("Bytes: \n%s", b)
+
+	root := parseMIME(b)
+	Expect(root.mediaType).To(Equal("multipart/mixed"))
+	Expect(root.mediaTypes()).To(Equal([]string{"multipart/alternative", "text/plain"}))
+
+	alternative := root.children[0]
+	Expect(alternative.mediaTypes()).To(Equal([]string{"text/plain", "multipart/related"}))
+
+	related := alternative.children[1]
+	Expect(related.mediaTypes()).To(Equal([]string{"text/html", "image/png"}))
+
+	image := related.children[1]
+	Expect(image.header.Get("Content-Id")).To(Equal("<logo.png>"))
+	Expect(image.header.Get("Content-Transfer-Encoding")).To(Equal("base64"))
+	disposition, params, err := mime.ParseMediaType(image.header.Get("Content-Disposition"))
+	expectNoError(err)
+	Expect(disposition).To(Equal("inline"))
+	Expect(params["filename"]).To(Equal("logo.png"))
+	matchBase64(bytes.NewReader(image.body), imageData, "inline image does not match")
+}
+
+func TestInlineImagesWithoutPlainBody(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.HTMLBody = `<img src="cid:logo.png">`
+	m.InlineImages = []Attachment{{
+		Name: "logo.png",
+		Data: strings.NewReader("image"),
+	}}
+
+	b, err := m.Bytes()
+	expectNoError(err)
+
+	root := parseMIME(b)
+	Expect(root.mediaType).To(Equal("multipart/related"))
+	Expect(root.mediaTypes()).To(Equal([]string{"text/html", "image/png"}))
+}
+
+func TestInlineImagesWithoutHTMLBody(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.Body = "Test message"
+	m.InlineImages = []Attachment{{
+		Name: "logo.png",
+		Data: strings.NewReader("image"),
+	}}
+
+	_, err := m.Bytes()
+	Expect(err).To(Equal(ErrInlineImagesWithoutHTMLBody))
+	Expect(m.ValidateAll()).To(ContainElement(ErrInlineImagesWithoutHTMLBody))
+}
+
+func TestInlineImageEncoding(t *testing.T) {
+	registerFailHandler(t)
+
+	svg := `<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10">` + "\n" +
+		`<rect width="10" height="10" fill="#ff0000"/>` + "\n" +
+		`</svg>` + "\n"
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.HTMLBody = `<p>Test message</p><img src="cid:logo.svg">`
+	m.InlineImages = []Attachment{{
+		Name:     "logo.svg",
+		Data:     strings.NewReader(svg),
+		Encoding: EncodingQuotedPrintable,
+	}}
+
+	b, err := m.Bytes()
+	expectNoError(err)
+
+	t.Logf("Bytes: \n%s", b)
+
+	related := parseMIME(b)
+	Expect(related.mediaType).To(Equal("multipart/related"))
+	Expect(related.mediaTypes()).To(Equal([]string{"text/html", "image/svg+xml"}))
+
+	html := related.children[0]
+	decodedHTML, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(html.body)))
+	expectNoError(err)
+	Expect(string(decodedHTML)).To(ContainSubstring(`src="cid:logo.svg"`))
+
+	image := related.children[1]
+	Expect(image.header.Get("Content-Id")).To(Equal("<logo.svg>"))
+	Expect(image.header.Get("Content-Transfer-Encoding")).To(Equal("quoted-printable"))
+	Expect(string(image.body)).To(ContainSubstring(`fill=3D"#ff0000"/>`))
+
+	// SVG isn't text/*, so its line breaks are kept as they are.
+	decoded, err := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(image.body)))
+	expectNoError(err)
+	Expect(string(decoded)).To(Equal(svg))
+}
+
+func TestWatchHTMLBody(t *testing.T) {
+	registerFailHandler(t)
+
+	watchBody := "<p>Short <b>watch</b> body</p>"
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.Body = "Test message"
+	m.HTMLBody = "<p>Test message</p>"
+	m.WatchHTMLBody = watchBody
+
+	b, err := m.Bytes()
+	expectNoError(err)
+
+	t.Logf("Bytes: \n%s", b)
+
+	root := parseMIME(b)
+	Expect(root.mediaType).To(Equal("multipart/alternative"))
+	Expect(root.mediaTypes()).To(Equal([]string{"text/plain", "text/watch-html", "text/html"}))
+
+	watch := root.children[1]
+	Expect(watch.header.Get("Content-Type")).To(Equal("text/watch-html; charset=utf-8"))
+	matchBase64(bytes.NewReader(watch.body), watchBody, "watch body does not match")
+}
+
+func TestDeterministicBoundary(t *testing.T) {
+	registerFailHandler(t)
+
+	newMessage := func() *Message {
+		m := &Message{}
+		m.SetFrom("Doman Sender <sender@domain.com>")
+		m.AddTo("First person <to_1@domain.com>")
+		m.Body = "Test message"
+		m.HTMLBody = `<img src="cid:logo.png">`
+		m.InlineImages = []Attachment{{
+			Name: "logo.png",
+			Data: strings.NewReader("image"),
+		}}
+		m.Attachments = []Attachment{{
+			Name: "test.txt",
+			Data: strings.NewReader("Test attachment"),
+		}}
+		m.Headers = mail.Header{}
+		m.Headers["Date"] = []string{"16 Oct 26 12:00 UTC"}
+		m.Headers["Message-Id"] = []string{"<test@domain.com>"}
+		m.Boundary = "golden"
+		return m
+	}
+
+	first, err := newMessage().Bytes()
+	expectNoError(err)
+	second, err := newMessage().Bytes()
+	expectNoError(err)
+
+	t.Logf("Bytes: \n%s", first)
+
+	Expect(string(first)).To(Equal(string(second)), "output is not reproducible")
+
+	root := parseMIME(first)
+	_, params := getContentType(root.header)
+	Expect(params["boundary"]).To(Equal("golden"))
+
+	alternative := root.children[0]
+	_, params = getContentType(alternative.header)
+	Expect(params["boundary"]).To(Equal("alt_golden"))
+
+	related := alternative.children[1]
+	_, params = getContentType(related.header)
+	Expect(params["boundary"]).To(Equal("rel_golden"))
+}
+
+func TestDeterministicBoundaryQuoted(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.Body = "Test message"
+	m.HTMLBody = "<p>Test message</p>"
+	m.Boundary = "golden (test):boundary"
+
+	b, err := m.Bytes()
+	expectNoError(err)
+
+	root := parseMIME(b)
+	_, params := getContentType(root.header)
+	Expect(params["boundary"]).To(Equal("golden (test):boundary"))
+	Expect(root.mediaTypes()).To(Equal([]string{"text/plain", "text/html"}))
+}
+
+func TestInvalidBoundary(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.Body = "Test message"
+
+	for _, boundary := range []string{
+		"golden<boundary>",
+		" golden",
+		"golden ",
+		"alt_alt_",
+		"gölden",
+		strings.Repeat("x", maxBoundaryLength-maxNestedBoundaryPrefixLength+1),
+	} {
+		m.Boundary = boundary
+		_, err := m.Bytes()
+		Expect(err).NotTo(BeNil(), "invalid boundary %q accepted", boundary)
+		Expect(m.Validate()).To(Equal(err))
+	}
+
+	m.Boundary = strings.Repeat("x", maxBoundaryLength-maxNestedBoundaryPrefixLength)
+	_, err := m.Bytes()
+	expectNoError(err)
+}
+
+func TestAttachmentFilenameParams(t *testing.T) {
+	registerFailHandler(t)
+
+	for _, test := range []struct {
+		params      FilenameParams
+		name        bool
+		filename    bool
+		description string
+	}{
+		{FilenameBoth, true, true, "both"},
+		{FilenameDisposition, false, true, "disposition"},
+		{FilenameContentType, true, false, "content type"},
+	} {
+		m := &Message{}
+		m.SetFrom("Doman Sender <sender@domain.com>")
+		m.AddTo("First person <to_1@domain.com>")
+		m.Body = "Test message"
+		m.Attachments = []Attachment{{
+			Name:           "test.txt",
+			ContentType:    "text/plain; charset=utf-8",
+			Data:           strings.NewReader("Test attachment"),
+			FilenameParams: test.params,
+		}}
+
+		b, err := m.Bytes()
+		expectNoError(err)
+
+		attachment := parseMIME(b).children[1]
+
+		mediaType, params := getContentType(attachment.header)
+		Expect(mediaType).To(Equal("text/plain"), test.description)
+		Expect(params["charset"]).To(Equal("utf-8"), test.description)
+		if test.name {
+			Expect(params["name"]).To(Equal("test.txt"), test.description)
+		} else {
+			Expect(params).NotTo(HaveKey("name"), test.description)
+		}
+
+		disposition, params, err := mime.ParseMediaType(attachment.header.Get("Content-Disposition"))
+		expectNoError(err)
+		Expect(disposition).To(Equal("attachment"), test.description)
+		if test.filename {
+			Expect(params["filename"]).To(Equal("test.txt"), test.description)
+		} else {
+			Expect(params).NotTo(HaveKey("filename"), test.description)
+		}
+	}
+}
+
+func TestAttachmentEncoding(t *testing.T) {
+	registerFailHandler(t)
+
+	binary := make([]byte, 1024)
+	for i := range binary {
+		binary[i] = byte(i)
+	}
+	text := strings.Repeat("date,level,message\nMon 02 Jan,INFO,Test line\n", 50)
+
+	// A PDF starts like text, but has binary data with bare
+	// line breaks further on.
+	pdf := []byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n" +
+		strings.Repeat("2 0 obj\n<< /Type /Pages /Kids [] /Count 0 >>\nendobj\n", 20) +
+		"3 0 obj\n<< /Length 8 /Filter /FlateDecode >>\nstream\n\x00\n\xff\r\x78\x9c\r\n\nendstream\nendobj\n%%EOF\n")
+
+	for _, test := range []struct {
+		data        []byte
+		contentType string
+		encoding    TransferEncoding
+		cte         string
+		description string
+	}{
+		{binary, "", EncodingBase64, "base64", "binary as base64"},
+		{binary, "", EncodingQuotedPrintable, "quoted-printable", "binary forced to quoted-printable"},
+		{binary, "", EncodingAuto, "base64", "binary under auto"},
+		{[]byte(text), "text/csv", EncodingAuto, "quoted-printable", "text under auto"},
+		{[]byte{}, "text/csv", EncodingAuto, "quoted-printable", "empty under auto"},
+		{[]byte(text), "", EncodingAuto, "quoted-printable", "text without a text type under auto"},
+		{pdf, "application/pdf", EncodingAuto, "quoted-printable", "pdf under auto"},
+		{pdf, "application/pdf", EncodingQuotedPrintable, "quoted-printable", "pdf forced to quoted-printable"},
+	} {
+		m := &Message{}
+		m.SetFrom("Doman Sender <sender@domain.com>")
+		m.AddTo("First person <to_1@domain.com>")
+		m.Body = "Test message"
+		m.Attachments = []Attachment{{
+			Name:        "test.dat",
+			ContentType: test.contentType,
+			Data:        bytes.NewReader(test.data),
+			Encoding:    test.encoding,
+		}}
+
+		b, err := m.Bytes()
+		expectNoError(err)
+
+		attachment := parseMIME(b).children[1]
+		Expect(attachment.header.Get("Content-Transfer-Encoding")).To(Equal(test.cte), test.description)
+
+		var decoded []byte
+		if test.cte == "base64" {
+			decoded, err = ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(attachment.body)))
+		} else {
+			decoded, err = ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(attachment.body)))
+		}
+		expectNoError(err)
+
+		if test.contentType == "text/csv" {
+			// Text line breaks become CRLF.
+			Expect(string(decoded)).To(Equal(strings.Replace(string(test.data), "\n", crlf, -1)), test.description)
+			// It stays readable in the raw message.
+			Expect(attachment.body).To(Equal(decoded), test.description)
+		} else {
+			Expect(decoded).To(Equal(test.data), test.description)
+		}
+	}
+}
+
+func TestBufferThreshold(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.Body = "Test message"
+	m.Headers = mail.Header{
+		"Date":       []string{"Mon, 02 Jan 2006 15:04:05 +0000"},
+		"Message-Id": []string{"<test@domain.com>"},
+	}
+	m.Boundary = "test-boundary"
+	m.BufferThreshold = 1024
+	m.Attachments = []Attachment{{
+		Name: "small.txt",
+		Data: strings.NewReader("Small attachment"),
+	}}
+
+	first, err := m.Bytes()
+	expectNoError(err)
+	second, err := m.Bytes()
+	expectNoError(err)
+	Expect(string(second)).To(Equal(string(first)))
+	Expect(string(first)).To(ContainSubstring(base64.StdEncoding.EncodeToString([]byte("Small attachment"))))
+
+	large := strings.Repeat("x", 2048)
+	m.Attachments = []Attachment{{
+		Name: "large.txt",
+		Data: strings.NewReader(large),
+	}}
+
+	b, err := m.Bytes()
+	expectNoError(err)
+
+	attachment := parseMIME(b).children[1]
+	decoded, err := base64.StdEncoding.DecodeString(strings.Replace(string(attachment.body), crlf, "", -1))
+	expectNoError(err)
+	Expect(string(decoded)).To(Equal(large))
+
+	_, err = m.Bytes()
+	Expect(err).To(Equal(ErrAttachmentStreamed))
+}
+
+func TestCalendar(t *testing.T) {
+	registerFailHandler(t)
+
+	ics := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nMETHOD:CANCEL\r\nBEGIN:VEVENT\r\nUID:1234@domain.com\r\nSUMMARY:Értekezlet\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.Body = "Test message"
+	m.HTMLBody = "<p>Test message</p>"
+	m.SetCalendar(ics, "CANCEL")
+
+	b, err := m.Bytes()
+	expectNoError(err)
+
+	t.Logf("Bytes: \n%s", b)
+
+	root := parseMIME(b)
+	Expect(root.mediaType).To(Equal("multipart/alternative"))
+	Expect(root.mediaTypes()).To(Equal([]string{"text/plain", "text/html", "text/calendar"}))
+
+	calendar := root.children[2]
+	_, params := getContentType(calendar.header)
+	Expect(params["method"]).To(Equal("CANCEL"))
+	Expect(params["charset"]).To(Equal("utf-8"))
+	matchBase64(bytes.NewReader(calendar.body), ics, "calendar does not match")
+
+	read, err := ReadMessage(bytes.NewReader(b))
+	expectNoError(err)
+	Expect(read.Calendar).To(Equal(ics))
+	Expect(read.CalendarMethod).To(Equal("CANCEL"))
+
+	m.CalendarMethod = ""
+	b, err = m.Bytes()
+	expectNoError(err)
+	_, params = getContentType(parseMIME(b).children[2].header)
+	Expect(params["method"]).To(Equal("REQUEST"))
+
+	m.CalendarMethod = "REQUEST; charset=latin1"
+	_, err = m.Bytes()
+	Expect(err).To(HaveOccurred())
+	Expect(m.Validate()).To(Equal(err))
+
+	// A calendar alone doesn't get an empty text/plain alternative.
+	m.Body = ""
+	m.HTMLBody = ""
+	m.SetCalendar(ics, "REQUEST")
+	b, err = m.Bytes()
+	expectNoError(err)
+	root = parseMIME(b)
+	Expect(root.mediaType).To(Equal("text/calendar"))
+	Expect(root.children).To(BeEmpty())
+
+	read, err = ReadMessage(bytes.NewReader(b))
+	expectNoError(err)
+	Expect(read.Calendar).To(Equal(ics))
+}
@@ -0,0 +1,229 @@
+package gophermail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// readMessageHeaders are the headers ReadMessage stores in dedicated
+// Message fields, or that Bytes generates, and so are left out of Headers.
+var readMessageHeaders = []string{
+	"From",
+	"Reply-To",
+	"To",
+	"Cc",
+	"Subject",
+	"Mime-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// ReadMessage parses an email message, e.g. one produced by Bytes,
+// back into a Message.
+//
+// The first text/plain, text/html, text/watch-html and text/calendar parts
+// that aren't attachments become Body, HTMLBody, WatchHTMLBody and
+// Calendar, parts with a Content-ID inside a multipart/related
+// container become InlineImages, and every other part becomes an
+// Attachment. Text is decoded to UTF-8 from the charset of its part,
+// and encoded-words from theirs.
+// Headers without a dedicated Message field are stored in Headers.
+func ReadMessage(r io.Reader) (*Message, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{}
+
+	dec := &mime.WordDecoder{CharsetReader: charsetReader}
+
+	from, err := readAddressList(msg.Header, "From", dec)
+	if err != nil {
+		return nil, err
+	}
+	if len(from) > 0 {
+		m.From = from[0]
+	}
+
+	replyTo, err := readAddressList(msg.Header, "Reply-To", dec)
+	if err != nil {
+		return nil, err
+	}
+	if len(replyTo) > 0 {
+		m.ReplyTo = replyTo[0]
+	}
+
+	m.To, err = readAddressList(msg.Header, "To", dec)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Cc, err = readAddressList(msg.Header, "Cc", dec)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Subject, err = dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range msg.Header {
+		if !isReadMessageHeader(k) {
+			if m.Headers == nil {
+				m.Headers = mail.Header{}
+			}
+			m.Headers[k] = v
+		}
+	}
+
+	err = m.readPart(textproto.MIMEHeader(msg.Header), msg.Body, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// readAddressList parses an address list header,
+// which may be missing. Display names are decoded with dec.
+func readAddressList(header mail.Header, key string, dec *mime.WordDecoder) ([]mail.Address, error) {
+	if header.Get(key) == "" {
+		return nil, nil
+	}
+
+	list, err := (&mail.AddressParser{WordDecoder: dec}).ParseList(header.Get(key))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s header: %v", key, err)
+	}
+
+	var addresses []mail.Address
+	for _, address := range list {
+		addresses = append(addresses, *address)
+	}
+	return addresses, nil
+}
+
+func isReadMessageHeader(key string) bool {
+	for _, k := range readMessageHeaders {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// readPart reads a MIME part into the message, descending into
+// multipart containers. parent is the media type of the enclosing
+// container, if any.
+func (m *Message) readPart(header textproto.MIMEHeader, body io.Reader, parent string) error {
+	mediaType := "text/plain"
+	var params map[string]string
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		var err error
+		mediaType, params, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return err
+		}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			err = m.readPart(part.Header, part, mediaType)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := readPartBody(header, body)
+	if err != nil {
+		return err
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if disposition != "attachment" {
+		var text *string
+		switch {
+		case mediaType == "text/plain" && m.Body == "":
+			text = &m.Body
+		case mediaType == "text/html" && m.HTMLBody == "":
+			text = &m.HTMLBody
+		case mediaType == "text/watch-html" && m.WatchHTMLBody == "":
+			text = &m.WatchHTMLBody
+		case mediaType == "text/calendar" && m.Calendar == "":
+			text = &m.Calendar
+			m.CalendarMethod = params["method"]
+		}
+
+		if text != nil {
+			// Text in an unknown charset is kept as it is.
+			cs, err := lookupCharset(params["charset"])
+			if err != nil {
+				*text = string(data)
+				return nil
+			}
+			*text, err = cs.decode(data)
+			return err
+		}
+	}
+
+	attachment := Attachment{
+		Name:        dispositionParams["filename"],
+		ContentType: mediaType,
+		Data:        bytes.NewReader(data),
+	}
+	if attachment.Name == "" {
+		attachment.Name = params["name"]
+	}
+
+	contentID := strings.Trim(header.Get("Content-Id"), "<>")
+	if parent == "multipart/related" && contentID != "" {
+		attachment.Name = contentID
+		m.InlineImages = append(m.InlineImages, attachment)
+	} else {
+		m.Attachments = append(m.Attachments, attachment)
+	}
+
+	return nil
+}
+
+// readPartBody reads and decodes the body of a single part
+// according to its Content-Transfer-Encoding.
+func readPartBody(header textproto.MIMEHeader, body io.Reader) ([]byte, error) {
+	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding")))
+	switch encoding {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "", "7bit", "8bit", "binary":
+	default:
+		return nil, fmt.Errorf("Unsupported Content-Transfer-Encoding %q.", encoding)
+	}
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding %s part: %v", encoding, err)
+	}
+	return data, nil
+}
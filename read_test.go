@@ -0,0 +1,155 @@
+package gophermail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestReadMessage(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.SetReplyTo("Reply person <reply@domain.com>")
+	m.AddTo("First person <to_1@domain.com>", "to_2@domain.com")
+	m.AddCc("Copied persón <cc_1@domain.com>")
+	m.Subject = "My Subject áűőú"
+	m.Body = "My Plain Text Body áűőú\nSecond line"
+	m.HTMLBody = "<p>My <b>HTML</b> Body</p>"
+	m.Attachments = []Attachment{{
+		Name:        "test.txt",
+		ContentType: "text/plain",
+		Data:        strings.NewReader("Test attachment"),
+	}}
+	m.Headers = mail.Header{}
+	m.Headers["X-Custom"] = []string{"custom value"}
+
+	b, err := m.Bytes()
+	expectNoError(err)
+
+	read, err := ReadMessage(bytes.NewReader(b))
+	expectNoError(err)
+
+	Expect(read.From).To(Equal(m.From))
+	Expect(read.ReplyTo).To(Equal(m.ReplyTo))
+	Expect(read.To).To(Equal(m.To))
+	Expect(read.Cc).To(Equal(m.Cc))
+	Expect(read.Subject).To(Equal(m.Subject))
+	Expect(strings.Replace(read.Body, "\r\n", "\n", -1)).To(Equal(m.Body))
+	Expect(read.HTMLBody).To(Equal(m.HTMLBody))
+	Expect(read.Headers.Get("X-Custom")).To(Equal("custom value"))
+	Expect(read.Headers).To(HaveKey("Date"))
+	Expect(read.Headers).NotTo(HaveKey("Content-Type"))
+
+	Expect(read.Attachments).To(HaveLen(1))
+	Expect(read.Attachments[0].Name).To(Equal("test.txt"))
+	Expect(read.Attachments[0].ContentType).To(Equal("text/plain"))
+	data, err := ioutil.ReadAll(read.Attachments[0].Data)
+	expectNoError(err)
+	Expect(string(data)).To(Equal("Test attachment"))
+}
+
+func TestReadMessageInlineImages(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("sender@domain.com")
+	m.AddTo("to_1@domain.com")
+	m.Body = "Test message"
+	m.HTMLBody = `<img src="cid:logo.png">`
+	m.InlineImages = []Attachment{{
+		Name: "logo.png",
+		Data: strings.NewReader("image"),
+	}}
+
+	b, err := m.Bytes()
+	expectNoError(err)
+
+	read, err := ReadMessage(bytes.NewReader(b))
+	expectNoError(err)
+
+	Expect(read.HTMLBody).To(Equal(m.HTMLBody))
+	Expect(read.Attachments).To(BeEmpty())
+	Expect(read.InlineImages).To(HaveLen(1))
+	Expect(read.InlineImages[0].Name).To(Equal("logo.png"))
+	Expect(read.InlineImages[0].ContentType).To(Equal("image/png"))
+}
+
+func TestReadMessageSinglePart(t *testing.T) {
+	registerFailHandler(t)
+
+	plain := "From: sender@domain.com\r\n" +
+		"To: to_1@domain.com\r\n" +
+		"\r\n" +
+		"Bare body\r\n"
+
+	read, err := ReadMessage(strings.NewReader(plain))
+	expectNoError(err)
+	Expect(read.Body).To(Equal("Bare body\r\n"))
+	Expect(read.HTMLBody).To(BeEmpty())
+
+	html := "From: sender@domain.com\r\n" +
+		"To: to_1@domain.com\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"<p>=C3=A1</p>"
+
+	read, err = ReadMessage(strings.NewReader(html))
+	expectNoError(err)
+	Expect(read.Body).To(BeEmpty())
+	Expect(read.HTMLBody).To(Equal("<p>á</p>"))
+}
+
+func TestReadMessageDecodingError(t *testing.T) {
+	registerFailHandler(t)
+
+	raw := "From: sender@domain.com\r\n" +
+		"To: to_1@domain.com\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Body\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=\"test.bin\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"not*base64!\r\n" +
+		"--b--\r\n"
+
+	_, err := ReadMessage(strings.NewReader(raw))
+	Expect(err).NotTo(BeNil(), "decoding error not reported")
+	Expect(err.Error()).To(ContainSubstring("base64"))
+}
+
+func TestReadMessageCharset(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.SetFrom("Kovács Nándor <sender@domain.com>")
+	m.AddTo("Őrült Győző <to_1@domain.com>")
+	m.Subject = "Árvíztűrő tükörfúrógép, árvíztűrő tükörfúrógép, árvíztűrő tükörfúrógép"
+	m.Body = "Őrült győző\nSecond line"
+	m.HTMLBody = "<p>Őrült győző</p>"
+	m.Charset = "iso-8859-2"
+
+	b, err := m.Bytes()
+	expectNoError(err)
+
+	read, err := ReadMessage(bytes.NewReader(b))
+	expectNoError(err)
+
+	Expect(read.From).To(Equal(m.From))
+	Expect(read.To).To(Equal(m.To))
+	Expect(read.Subject).To(Equal(m.Subject))
+	Expect(strings.Replace(read.Body, "\r\n", "\n", -1)).To(Equal(m.Body))
+	Expect(read.HTMLBody).To(Equal(m.HTMLBody))
+}
@@ -1,68 +1,367 @@
 package gophermail
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
 )
 
+var ErrETRNNotSupported = errors.New("The server does not support ETRN.")
+var ErrTLSRequired = errors.New("The server does not support STARTTLS, but TLS is required.")
+
+// A SendOption configures how messages are sent over SMTP.
+type SendOption func(*sendOptions)
+
+// sendOptions holds the settings configured by SendOptions.
+type sendOptions struct {
+	localName      string
+	requireTLS     bool
+	implicitTLS    bool
+	onRecipient    RecipientFunc
+	partialSuccess bool
+
+	// dial, if set, replaces net.Dialer in tests.
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// newSendOptions applies opts to the default settings.
+func newSendOptions(opts []SendOption) *sendOptions {
+	o := &sendOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithLocalName sets the host name sent with HELO/EHLO.
+// Some servers reject or penalize the default, "localhost".
+func WithLocalName(name string) SendOption {
+	return func(o *sendOptions) {
+		o.localName = name
+	}
+}
+
+// WithRequireTLS makes sending fail with ErrTLSRequired if the server
+// doesn't offer STARTTLS. The error is returned right after EHLO,
+// before AUTH and MAIL FROM, so neither the credentials nor the
+// message are sent in plain text. Without this option, they are sent
+// in plain text to such a server.
+// A failed STARTTLS handshake fails the send with or without it.
+// With WithImplicitTLS, the connection always uses TLS, so this
+// option has no effect there.
+func WithRequireTLS() SendOption {
+	return func(o *sendOptions) {
+		o.requireTLS = true
+	}
+}
+
+// A RecipientFunc is called with the server's response to the RCPT
+// command of each recipient, e.g. 250 if it was accepted, or 550
+// if the mailbox doesn't exist.
+type RecipientFunc func(address string, code int, msg string)
+
+// WithRecipientFunc makes f get called for each recipient as the server
+// accepts or rejects it, for tracking delivery to each recipient.
+// Every recipient is tried, so that each is reported, but a rejected
+// recipient still fails the send, unless WithPartialSuccess is used.
+func WithRecipientFunc(f RecipientFunc) SendOption {
+	return func(o *sendOptions) {
+		o.onRecipient = f
+	}
+}
+
+// WithPartialSuccess makes rejected recipients not fail the send:
+// the message is sent to the recipients that the server accepts,
+// and sending only fails if all of them are rejected.
+// Use WithRecipientFunc to find out which were rejected.
+func WithPartialSuccess() SendOption {
+	return func(o *sendOptions) {
+		o.partialSuccess = true
+	}
+}
+
+// WithImplicitTLS makes the connection use TLS from the start, as on
+// port 465 (RFC 8314), instead of switching to it with STARTTLS.
+func WithImplicitTLS() SendOption {
+	return func(o *sendOptions) {
+		o.implicitTLS = true
+	}
+}
+
+// dialContext connects to addr with d, or with the dial option if set.
+func (o *sendOptions) dialContext(ctx context.Context, d *net.Dialer, addr string) (net.Conn, error) {
+	if o.dial != nil {
+		return o.dial(ctx, "tcp", addr)
+	}
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+// Default ports for addresses without one, by TLS mode.
+const (
+	smtpPort        = "25"
+	submissionPort  = "587"
+	submissionsPort = "465"
+)
+
+// resolveAddr adds the default port for the TLS mode to addr
+// if it doesn't have a port: 465 with WithImplicitTLS,
+// 587 with WithRequireTLS, and 25 otherwise.
+func (o *sendOptions) resolveAddr(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+
+	port := smtpPort
+	switch {
+	case o.implicitTLS:
+		port = submissionsPort
+	case o.requireTLS:
+		port = submissionPort
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
 type smtpSender struct {
 	addr   string
 	auth   smtp.Auth
 	tlsCfg *tls.Config
+	opts   *sendOptions
 }
 
 func (s *smtpSender) SendMail(msg *Message) error {
-	if s.tlsCfg == nil {
-		return SendMail(s.addr, s.auth, msg)
-	}
-	return SendTLSMail(s.addr, s.auth, msg, s.tlsCfg)
+	return s.SendMailContext(context.Background(), msg)
+}
+
+func (s *smtpSender) SendMailContext(ctx context.Context, msg *Message) error {
+	_, err := sendMail(ctx, s.addr, s.auth, msg, s.tlsCfg, s.opts)
+	return err
 }
 
 // NewSMTPSender creates a new Sender using smtp to send messages.
 // auth and tlsCfg are optional.
-func NewSMTPSender(addr string, auth smtp.Auth, tlsCfg *tls.Config) Sender {
+// If addr has no port, a default is chosen based on the options.
+func NewSMTPSender(addr string, auth smtp.Auth, tlsCfg *tls.Config, opts ...SendOption) Sender {
 	return &smtpSender{
 		addr:   addr,
 		auth:   auth,
 		tlsCfg: tlsCfg,
+		opts:   newSendOptions(opts),
 	}
 }
 
 // SendMail connects to the server at addr, switches to TLS if possible,
 // authenticates with mechanism a if possible, and then sends the given Message.
+// If addr has no port, port 25 is used.
 //
 // Based heavily on smtp.SendMail().
 func SendMail(addr string, a smtp.Auth, msg *Message) error {
-	msgBytes, err := msg.Bytes()
+	_, err := sendMail(context.Background(), addr, a, msg, nil, newSendOptions(nil))
+	return err
+}
+
+// SendTLSMail does the same thing as SendMail, except with the added
+// option of providing a tls.Config
+func SendTLSMail(addr string, a smtp.Auth, msg *Message, cfg *tls.Config, opts ...SendOption) error {
+	_, err := sendMail(context.Background(), addr, a, msg, cfg, newSendOptions(opts))
+	return err
+}
+
+// SendMailContext does the same thing as SendMail, but gives up when ctx
+// is done. The connection to the server is closed at whatever stage the
+// send is at, and ctx.Err() is returned.
+func SendMailContext(ctx context.Context, addr string, a smtp.Auth, msg *Message) error {
+	_, err := sendMail(ctx, addr, a, msg, nil, newSendOptions(nil))
+	return err
+}
+
+// SendTLSMailContext does the same thing as SendTLSMail, but gives up
+// when ctx is done, like SendMailContext.
+func SendTLSMailContext(ctx context.Context, addr string, a smtp.Auth, msg *Message, cfg *tls.Config, opts ...SendOption) error {
+	_, err := sendMail(ctx, addr, a, msg, cfg, newSendOptions(opts))
+	return err
+}
+
+// SendResult describes the outcome of sending a message.
+type SendResult struct {
+	// Index is the position of the message in a batch.
+	Index int
+
+	// Success reports whether the server accepted the message.
+	Success bool
+
+	// QueueID is the id the server queued the message under,
+	// if its response to DATA included a recognizable one.
+	QueueID string
+
+	// Err is the reason the message wasn't sent.
+	Err error
+
+	// TLS is the state of the connection after STARTTLS,
+	// or nil if the message was sent without TLS.
+	TLS *tls.ConnectionState
+}
+
+// SendMailResult does the same thing as SendMail,
+// and also returns the details of the send, e.g. for auditing.
+func SendMailResult(addr string, a smtp.Auth, msg *Message) (*SendResult, error) {
+	return sendMail(context.Background(), addr, a, msg, nil, newSendOptions(nil))
+}
+
+// SendTLSMailResult does the same thing as SendTLSMail,
+// and also returns the details of the send, e.g. for auditing.
+func SendTLSMailResult(addr string, a smtp.Auth, msg *Message, cfg *tls.Config, opts ...SendOption) (*SendResult, error) {
+	return sendMail(context.Background(), addr, a, msg, cfg, newSendOptions(opts))
+}
+
+// sendMail implements SendMail and SendTLSMail and their variants.
+// If cfg is nil, a default config for the host in addr is used.
+func sendMail(ctx context.Context, addr string, a smtp.Auth, msg *Message, cfg *tls.Config, opts *sendOptions) (*SendResult, error) {
+	msgData, size, err := messageData(msg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var to []string
-	for _, address := range msg.To {
-		to = append(to, address.Address)
+	from, to := envelope(msg)
+
+	addr = opts.resolveAddr(addr)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		cfg = &tls.Config{ServerName: host}
 	}
 
-	for _, address := range msg.Cc {
-		to = append(to, address.Address)
+	conn, err := opts.dialContext(ctx, &net.Dialer{}, addr)
+	if err != nil {
+		return nil, contextError(ctx, err)
 	}
+	defer conn.Close()
 
-	for _, address := range msg.Bcc {
-		to = append(to, address.Address)
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		err = conn.SetDeadline(deadline)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return smtp.SendMail(addr, a, msg.From.Address, to, msgBytes)
+	// Closing the connection when ctx is done unblocks whatever
+	// the client is waiting on, at any stage of the exchange.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	var sessionConn net.Conn = conn
+	if opts.implicitTLS {
+		sessionConn = tls.Client(conn, cfg)
+	}
+
+	result, err := send(sessionConn, host, a, cfg, opts, from, to, msgData, size)
+	if err != nil {
+		return nil, contextError(ctx, unwrapAttachmentError(err))
+	}
+	return result, nil
 }
 
-// SendTLSMail does the same thing as SendMail, except with the added
-// option of providing a tls.Config
-func SendTLSMail(addr string, a smtp.Auth, msg *Message, cfg *tls.Config) error {
+// contextError returns ctx.Err() if err was caused by ctx being done,
+// e.g. the error of a connection that was closed or timed out because
+// of it, and err otherwise.
+func contextError(ctx context.Context, err error) error {
+	// The connection deadline can expire just before ctx does.
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			<-ctx.Done()
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// send runs the SMTP exchange on a connection.
+func send(conn net.Conn, host string, a smtp.Auth, cfg *tls.Config, opts *sendOptions, from string, to []string, msgData io.WriterTo, size int64) (*SendResult, error) {
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	result, err := startSession(c, a, cfg, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result.QueueID, err = transmit(c, from, to, msgData, size, opts)
+	if err != nil {
+		return nil, err
+	}
+	result.Success = true
+
+	err = c.Quit()
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// messageData returns the encoded message to send as DATA, and its size.
+//
+// Messages with attachments are streamed with WriteTo, so that they
+// don't have to fit in memory, and their size is unknown (-1).
+// Errors reading the attachments while the message is written are
+// returned as attachmentErrors.
+// Other messages are small, so they are encoded up front to
+// declare their size.
+func messageData(msg *Message) (io.WriterTo, int64, error) {
+	if msg.DKIM == nil && (len(msg.Attachments) > 0 || len(msg.InlineImages) > 0) {
+		e, err := msg.encode()
+		if err != nil {
+			return nil, 0, unwrapAttachmentError(err)
+		}
+		return e, -1, nil
+	}
+
 	msgBytes, err := msg.Bytes()
 	if err != nil {
-		return err
+		return nil, 0, err
+	}
+	return encodedBytes(msgBytes), int64(len(msgBytes)), nil
+}
+
+// encodedBytes is an encoded message that can be written any number of times.
+type encodedBytes []byte
+
+func (b encodedBytes) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// envelope returns the SMTP envelope sender and recipients of a message.
+// A resent message only goes to the ResentTo recipients.
+func envelope(msg *Message) (from string, to []string) {
+	if msg.isResent() {
+		for _, address := range msg.ResentTo {
+			to = append(to, address.Address)
+		}
+		return msg.envelopeFrom(), to
 	}
 
-	var to []string
 	for _, address := range msg.To {
 		to = append(to, address.Address)
 	}
@@ -71,56 +370,211 @@ func SendTLSMail(addr string, a smtp.Auth, msg *Message, cfg *tls.Config) error
 		to = append(to, address.Address)
 	}
 
+	for _, address := range groupAddresses(msg.ToGroups) {
+		to = append(to, address.Address)
+	}
+
+	for _, address := range groupAddresses(msg.CcGroups) {
+		to = append(to, address.Address)
+	}
+
 	for _, address := range msg.Bcc {
 		to = append(to, address.Address)
 	}
 
-	from := msg.From.Address
+	return msg.envelopeFrom(), to
+}
 
-	c, err := smtp.Dial(addr)
-	if err != nil {
-		return err
+// startSession greets the server, switches to TLS if possible
+// and authenticates with mechanism a if possible.
+func startSession(c *smtp.Client, a smtp.Auth, cfg *tls.Config, opts *sendOptions) (*SendResult, error) {
+	result := &SendResult{}
+
+	if opts.localName != "" {
+		if err := c.Hello(opts.localName); err != nil {
+			return nil, err
+		}
 	}
-	defer c.Close()
 
 	if ok, _ := c.Extension("STARTTLS"); ok {
-		if err = c.StartTLS(cfg); err != nil {
-			return err
+		if err := c.StartTLS(cfg); err != nil {
+			return nil, err
 		}
 	}
+	if state, ok := c.TLSConnectionState(); ok {
+		result.TLS = &state
+	}
+
+	if opts.requireTLS && result.TLS == nil {
+		return nil, ErrTLSRequired
+	}
 
 	if a != nil {
 		if ok, _ := c.Extension("AUTH"); ok {
-			if err = c.Auth(a); err != nil {
-				return err
+			if err := c.Auth(a); err != nil {
+				return nil, err
 			}
 		}
 	}
 
-	if err = c.Mail(from); err != nil {
-		return err
+	return result, nil
+}
+
+// transmit runs a single MAIL, RCPT, DATA mail transaction.
+// size is the size of msgData, or -1 if it is unknown.
+// If opts has a RecipientFunc, it is called for each recipient.
+// It returns the queue id reported by the server, if any.
+func transmit(c *smtp.Client, from string, to []string, msgData io.WriterTo, size int64, opts *sendOptions) (string, error) {
+	err := mailFrom(c, from, size)
+	if err != nil {
+		return "", err
 	}
 
+	var firstErr error
+	accepted := 0
 	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
-			return err
+		code, msg, err := rcpt(c, addr)
+		if err != nil {
+			protocolErr, ok := err.(*textproto.Error)
+			if !ok {
+				return "", err
+			}
+			code, msg = protocolErr.Code, protocolErr.Msg
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			accepted++
 		}
+
+		if opts.onRecipient != nil {
+			opts.onRecipient(addr, code, msg)
+		} else if firstErr != nil && !opts.partialSuccess {
+			return "", firstErr
+		}
+	}
+
+	if firstErr != nil && (accepted == 0 || !opts.partialSuccess) {
+		return "", firstErr
 	}
 
-	w, err := c.Data()
+	return data(c, msgData)
+}
+
+// rcpt issues a RCPT command like smtp.Client.Rcpt,
+// and also returns the server's response.
+func rcpt(c *smtp.Client, to string) (int, string, error) {
+	if strings.ContainsAny(to, "\r\n") {
+		return 0, "", errors.New("smtp: A line must not contain CR or LF")
+	}
+
+	id, err := c.Text.Cmd("RCPT TO:<%s>", to)
 	if err != nil {
-		return err
+		return 0, "", err
 	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+
+	return c.Text.ReadResponse(25)
+}
 
-	_, err = w.Write(msgBytes)
+// queueIDRegexp matches the queue id in the DATA responses of common
+// servers, e.g. Postfix's "2.0.0 Ok: queued as 4FZ3kq1T2z"
+// and Exim's "OK id=1rAbCd-000123-4X".
+var queueIDRegexp = regexp.MustCompile(`(?i)(?:queued as|id=)\s*([^\s;,]+)`)
+
+// data issues a DATA command like smtp.Client.Data, sends the message,
+// and returns the queue id from the server's response, if any.
+// smtp.Client discards that response.
+//
+// If writing msgData fails, the message isn't terminated, so that the
+// server doesn't accept a partial message when the connection is closed.
+func data(c *smtp.Client, msgData io.WriterTo) (string, error) {
+	id, err := c.Text.Cmd("DATA")
 	if err != nil {
-		return err
+		return "", err
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(354)
+	c.Text.EndResponse(id)
+	if err != nil {
+		return "", err
 	}
 
+	w := c.Text.DotWriter()
+	_, err = msgData.WriteTo(w)
+	if err != nil {
+		return "", err
+	}
 	err = w.Close()
+	if err != nil {
+		return "", err
+	}
+
+	_, msg, err := c.Text.ReadResponse(250)
+	if err != nil {
+		return "", err
+	}
+
+	if m := queueIDRegexp.FindStringSubmatch(msg); m != nil {
+		return m[1], nil
+	}
+	return "", nil
+}
+
+// mailFrom issues a MAIL command like smtp.Client.Mail, and also
+// declares the size of the message if the server supports the SIZE
+// extension (RFC 1870), so that it can reject messages that are too
+// large before they are transmitted.
+// A negative size means the size is unknown and isn't declared.
+func mailFrom(c *smtp.Client, from string, size int64) error {
+	if strings.ContainsAny(from, "\r\n") {
+		return errors.New("smtp: A line must not contain CR or LF")
+	}
+
+	cmd := "MAIL FROM:<%s>"
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		cmd += " SMTPUTF8"
+	}
+	if ok, _ := c.Extension("SIZE"); ok && size >= 0 {
+		cmd += fmt.Sprintf(" SIZE=%d", size)
+	}
+
+	id, err := c.Text.Cmd(cmd, from)
+	if err != nil {
+		return err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+
+	_, _, err = c.Text.ReadResponse(250)
+	return err
+}
+
+// ETRN asks the server to start delivering the mail it has queued
+// for domain, as described in RFC 1985.
+// This lets an intermittently connected relay request its mail on demand.
+// ErrETRNNotSupported is returned if the server doesn't advertise ETRN.
+func ETRN(c *smtp.Client, domain string) error {
+	if strings.ContainsAny(domain, "\r\n") {
+		return errors.New("smtp: A line must not contain CR or LF")
+	}
+
+	if ok, _ := c.Extension("ETRN"); !ok {
+		return ErrETRNNotSupported
+	}
+
+	id, err := c.Text.Cmd("ETRN %s", domain)
 	if err != nil {
 		return err
 	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
 
-	return c.Quit()
+	// Any of 250, 251, 252 and 253 indicate success.
+	_, _, err = c.Text.ReadResponse(25)
+	return err
 }
@@ -0,0 +1,803 @@
+package gophermail
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+// fakeSMTPServer is a minimal SMTP server that records the commands
+// it receives.
+type fakeSMTPServer struct {
+	listener   net.Listener
+	extensions []string
+
+	// tlsConfig, if set, enables STARTTLS.
+	tlsConfig *tls.Config
+
+	// reply, if set, can override the response to a command.
+	// It returns an empty string to use the default response.
+	reply func(cmd string) string
+
+	// hang is a verb the server never responds to.
+	hang string
+
+	// drop, if set, can make the server close the connection
+	// instead of responding to a command.
+	drop func(cmd string) bool
+
+	// dropData makes the server close the connection in the middle
+	// of DATA, after the first line of the message.
+	dropData bool
+
+	// disconnected receives a value whenever a client disconnects.
+	disconnected chan struct{}
+
+	mu       sync.Mutex
+	commands []string
+	messages []string
+}
+
+// newFakeSMTPServer starts a fake server advertising the given extensions.
+// The server is closed when the test finishes.
+func newFakeSMTPServer(t *testing.T, extensions ...string) *fakeSMTPServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveFakeSMTP(t, l, extensions...)
+}
+
+// newFakeImplicitTLSSMTPServer starts a fake server
+// that uses TLS from the start, like on port 465.
+func newFakeImplicitTLSSMTPServer(t *testing.T, cfg *tls.Config, extensions ...string) *fakeSMTPServer {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveFakeSMTP(t, l, extensions...)
+}
+
+// serveFakeSMTP starts a fake server on l.
+func serveFakeSMTP(t *testing.T, l net.Listener, extensions ...string) *fakeSMTPServer {
+	s := &fakeSMTPServer{
+		listener:     l,
+		extensions:   extensions,
+		disconnected: make(chan struct{}, 100),
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *fakeSMTPServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Commands returns the commands received so far.
+func (s *fakeSMTPServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Messages returns the contents of every DATA command received so far.
+func (s *fakeSMTPServer) Messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+// Count returns the number of received commands starting with verb.
+func (s *fakeSMTPServer) Count(verb string) int {
+	count := 0
+	for _, cmd := range s.Commands() {
+		if strings.HasPrefix(strings.ToUpper(cmd), verb) {
+			count++
+		}
+	}
+	return count
+}
+
+// Command returns the first received command starting with verb.
+func (s *fakeSMTPServer) Command(verb string) (string, bool) {
+	for _, cmd := range s.Commands() {
+		if strings.HasPrefix(strings.ToUpper(cmd), verb) {
+			return cmd, true
+		}
+	}
+	return "", false
+}
+
+func (s *fakeSMTPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSMTPServer) handle(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.disconnected <- struct{}{}
+	}()
+	text := textproto.NewConn(conn)
+	tlsActive := false
+
+	text.PrintfLine("220 localhost fake ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		s.mu.Unlock()
+
+		if s.drop != nil && s.drop(line) {
+			return
+		}
+
+		if s.reply != nil {
+			if resp := s.reply(line); resp != "" {
+				text.PrintfLine("%s", resp)
+				continue
+			}
+		}
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		if verb == s.hang {
+			continue
+		}
+		switch verb {
+		case "EHLO":
+			lines := append([]string{"localhost"}, s.extensions...)
+			if s.tlsConfig != nil && !tlsActive {
+				lines = append(lines, "STARTTLS")
+			}
+			for i, l := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				text.PrintfLine("250%s%s", sep, l)
+			}
+		case "HELO", "MAIL", "RCPT", "RSET", "NOOP", "ETRN":
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			if s.dropData {
+				text.ReadLine()
+				return
+			}
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, string(data))
+			queueID := len(s.messages)
+			s.mu.Unlock()
+			text.PrintfLine("250 2.0.0 Ok: queued as Q%d", queueID)
+		case "STARTTLS":
+			if s.tlsConfig == nil || tlsActive {
+				text.PrintfLine("502 Command not implemented")
+				continue
+			}
+			text.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			text = textproto.NewConn(conn)
+			tlsActive = true
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// newTestTLSConfigs creates a self-signed certificate for 127.0.0.1 and
+// returns a server config using it and a client config trusting it.
+func newTestTLSConfigs(t *testing.T) (server *tls.Config, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	client = &tls.Config{
+		RootCAs:    pool,
+		ServerName: "127.0.0.1",
+	}
+	return server, client
+}
+
+func TestETRN(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t, "ETRN")
+
+	c, err := smtp.Dial(server.Addr())
+	expectNoError(err)
+	defer c.Close()
+
+	expectNoError(ETRN(c, "domain.com"))
+	expectNoError(c.Quit())
+
+	cmd, ok := server.Command("ETRN")
+	Expect(ok).To(BeTrue(), "ETRN command not sent")
+	Expect(cmd).To(Equal("ETRN domain.com"))
+}
+
+func TestETRNNotSupported(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t)
+
+	c, err := smtp.Dial(server.Addr())
+	expectNoError(err)
+	defer c.Close()
+
+	Expect(ETRN(c, "domain.com")).To(Equal(ErrETRNNotSupported))
+
+	_, ok := server.Command("ETRN")
+	Expect(ok).To(BeFalse(), "ETRN command sent to a server without ETRN")
+}
+
+// testSendMessage returns a simple message for the send tests.
+func testSendMessage() *Message {
+	m := &Message{}
+	m.SetFrom("Doman Sender <sender@domain.com>")
+	m.AddTo("First person <to_1@domain.com>")
+	m.Body = "Test message"
+	return m
+}
+
+func TestSendMailSize(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t, "SIZE 1000000")
+
+	expectNoError(SendMail(server.Addr(), nil, testSendMessage()))
+
+	cmd, ok := server.Command("MAIL")
+	Expect(ok).To(BeTrue(), "MAIL command not sent")
+	t.Log(cmd)
+
+	m := regexp.MustCompile(`^MAIL FROM:<sender@domain.com> SIZE=(\d+)$`).FindStringSubmatch(cmd)
+	Expect(m).NotTo(BeNil(), "SIZE parameter missing")
+
+	size, err := strconv.Atoi(m[1])
+	expectNoError(err)
+
+	messages := server.Messages()
+	Expect(messages).To(HaveLen(1))
+	Expect(size).To(Equal(len(strings.Replace(messages[0], "\n", "\r\n", -1))), "declared size doesn't match the message")
+}
+
+func TestSendMailNoSize(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t, "8BITMIME")
+
+	expectNoError(SendMail(server.Addr(), nil, testSendMessage()))
+
+	cmd, ok := server.Command("MAIL")
+	Expect(ok).To(BeTrue(), "MAIL command not sent")
+	Expect(cmd).To(Equal("MAIL FROM:<sender@domain.com> BODY=8BITMIME"))
+}
+
+func TestSendMailBcc(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t)
+
+	m := testSendMessage()
+	expectNoError(m.AddCc("cc_1@domain.com"))
+	expectNoError(m.AddBcc("bcc_1@domain.com"))
+
+	expectNoError(SendMail(server.Addr(), nil, m))
+
+	var rcpts []string
+	for _, cmd := range server.Commands() {
+		if strings.HasPrefix(cmd, "RCPT") {
+			rcpts = append(rcpts, cmd)
+		}
+	}
+	Expect(rcpts).To(Equal([]string{
+		"RCPT TO:<to_1@domain.com>",
+		"RCPT TO:<cc_1@domain.com>",
+		"RCPT TO:<bcc_1@domain.com>",
+	}))
+
+	messages := server.Messages()
+	Expect(messages).To(HaveLen(1))
+	Expect(messages[0]).NotTo(ContainSubstring("bcc_1@domain.com"), "Bcc address found in message")
+}
+
+func TestSendMailResent(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t)
+
+	m := testSendMessage()
+	expectNoError(m.AddCc("cc_1@domain.com"))
+	expectNoError(m.AddBcc("bcc_1@domain.com"))
+	expectNoError(m.SetResent("Resender <resender@forward.com>", "to_2@domain.com, to_3@domain.com"))
+
+	expectNoError(SendMail(server.Addr(), nil, m))
+
+	cmd, ok := server.Command("MAIL")
+	Expect(ok).To(BeTrue(), "MAIL command not sent")
+	Expect(cmd).To(Equal("MAIL FROM:<resender@forward.com>"))
+
+	var rcpts []string
+	for _, cmd := range server.Commands() {
+		if strings.HasPrefix(cmd, "RCPT") {
+			rcpts = append(rcpts, cmd)
+		}
+	}
+	Expect(rcpts).To(Equal([]string{
+		"RCPT TO:<to_2@domain.com>",
+		"RCPT TO:<to_3@domain.com>",
+	}))
+
+	m.EnvelopeFrom = "bounces@forward.com"
+	expectNoError(SendMail(server.Addr(), nil, m))
+	Expect(server.Commands()).To(ContainElement("MAIL FROM:<bounces@forward.com>"))
+
+	m.ResentTo = nil
+	Expect(SendMail(server.Addr(), nil, m)).To(Equal(ErrMissingRecipient))
+}
+
+func TestSendTLSMailResult(t *testing.T) {
+	registerFailHandler(t)
+
+	serverCfg, clientCfg := newTestTLSConfigs(t)
+	serverCfg.MaxVersion = tls.VersionTLS12
+
+	server := newFakeSMTPServer(t)
+	server.tlsConfig = serverCfg
+
+	result, err := SendTLSMailResult(server.Addr(), nil, testSendMessage(), clientCfg)
+	expectNoError(err)
+
+	Expect(result.TLS).NotTo(BeNil(), "TLS state not reported")
+	Expect(result.TLS.Version).To(Equal(uint16(tls.VersionTLS12)), "wrong TLS version reported")
+	Expect(result.TLS.CipherSuite).NotTo(BeZero(), "cipher suite not reported")
+	Expect(server.Messages()).To(HaveLen(1))
+}
+
+func TestSendMailResultWithoutTLS(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t)
+
+	result, err := SendMailResult(server.Addr(), nil, testSendMessage())
+	expectNoError(err)
+
+	Expect(result.TLS).To(BeNil(), "TLS state reported for a plaintext send")
+}
+
+func TestSendMailContextCancel(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t)
+	server.hang = "RCPT"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err := SendMailContext(ctx, server.Addr(), nil, testSendMessage())
+	Expect(err).To(Equal(context.Canceled))
+	Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second), "send did not stop when canceled")
+
+	select {
+	case <-server.disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed after cancel")
+	}
+	Expect(server.Messages()).To(BeEmpty())
+}
+
+func TestSendMailContextCanceledBeforeDial(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := SendMailContext(ctx, server.Addr(), nil, testSendMessage())
+	Expect(err).To(Equal(context.Canceled))
+
+	ctx, cancel = context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+
+	err = SendMailContext(ctx, server.Addr(), nil, testSendMessage())
+	Expect(err).To(Equal(context.DeadlineExceeded))
+	Expect(server.Commands()).To(BeEmpty())
+}
+
+func TestSendMailContextTimeout(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t)
+	server.hang = "DATA"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	sender := NewSMTPSender(server.Addr(), nil, nil)
+	err := sender.SendMailContext(ctx, testSendMessage())
+	Expect(err).To(Equal(context.DeadlineExceeded))
+
+	select {
+	case <-server.disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed after timeout")
+	}
+}
+
+func TestSendMailResultQueueID(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t)
+
+	result, err := SendMailResult(server.Addr(), nil, testSendMessage())
+	expectNoError(err)
+
+	Expect(result.Success).To(BeTrue())
+	Expect(result.QueueID).To(Equal("Q1"))
+}
+
+func TestSendMailLocalName(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t)
+
+	expectNoError(SendTLSMail(server.Addr(), nil, testSendMessage(), nil, WithLocalName("mail.domain.com")))
+
+	cmd, ok := server.Command("EHLO")
+	Expect(ok).To(BeTrue(), "EHLO command not sent")
+	Expect(cmd).To(Equal("EHLO mail.domain.com"))
+	Expect(server.Count("EHLO")).To(Equal(1))
+
+	sender := NewSMTPSender(server.Addr(), nil, nil, WithLocalName("sender.domain.com"))
+	expectNoError(sender.SendMail(testSendMessage()))
+	Expect(server.Commands()).To(ContainElement("EHLO sender.domain.com"))
+}
+
+func TestSendMailDefaultLocalName(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t)
+
+	expectNoError(SendMail(server.Addr(), nil, testSendMessage()))
+
+	cmd, ok := server.Command("EHLO")
+	Expect(ok).To(BeTrue(), "EHLO command not sent")
+	Expect(cmd).To(Equal("EHLO localhost"))
+}
+
+func TestSendMailRequireTLS(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t, "AUTH PLAIN")
+
+	auth := smtp.PlainAuth("", "user", "secret", "127.0.0.1")
+	err := SendTLSMail(server.Addr(), auth, testSendMessage(), nil, WithRequireTLS())
+	Expect(err).To(Equal(ErrTLSRequired))
+
+	Expect(server.Count("AUTH")).To(BeZero(), "credentials sent without TLS")
+	Expect(server.Count("MAIL")).To(BeZero(), "message sent without TLS")
+	Expect(server.Messages()).To(BeEmpty())
+
+	serverCfg, clientCfg := newTestTLSConfigs(t)
+	server = newFakeSMTPServer(t)
+	server.tlsConfig = serverCfg
+
+	sender := NewSMTPSender(server.Addr(), nil, clientCfg, WithRequireTLS())
+	expectNoError(sender.SendMail(testSendMessage()))
+	Expect(server.Messages()).To(HaveLen(1))
+
+	// Implicit TLS doesn't need STARTTLS.
+	server = newFakeImplicitTLSSMTPServer(t, serverCfg)
+	sender = NewSMTPSender(server.Addr(), nil, clientCfg, WithImplicitTLS(), WithRequireTLS())
+	expectNoError(sender.SendMail(testSendMessage()))
+	Expect(server.Count("STARTTLS")).To(BeZero())
+	Expect(server.Messages()).To(HaveLen(1))
+}
+
+func TestResolveAddr(t *testing.T) {
+	registerFailHandler(t)
+
+	for _, test := range []struct {
+		addr     string
+		opts     []SendOption
+		expected string
+	}{
+		{"mail.domain.com", nil, "mail.domain.com:25"},
+		{"mail.domain.com", []SendOption{WithRequireTLS()}, "mail.domain.com:587"},
+		{"mail.domain.com", []SendOption{WithImplicitTLS()}, "mail.domain.com:465"},
+		{"mail.domain.com", []SendOption{WithImplicitTLS(), WithRequireTLS()}, "mail.domain.com:465"},
+		{"mail.domain.com:2525", []SendOption{WithImplicitTLS()}, "mail.domain.com:2525"},
+		{"::1", []SendOption{WithRequireTLS()}, "[::1]:587"},
+		{"[::1]", nil, "[::1]:25"},
+	} {
+		Expect(newSendOptions(test.opts).resolveAddr(test.addr)).To(Equal(test.expected), test.addr)
+	}
+}
+
+func TestSendMailDefaultPort(t *testing.T) {
+	registerFailHandler(t)
+
+	serverCfg, clientCfg := newTestTLSConfigs(t)
+
+	plain := newFakeSMTPServer(t)
+	startTLS := newFakeSMTPServer(t)
+	startTLS.tlsConfig = serverCfg
+	implicitTLS := newFakeImplicitTLSSMTPServer(t, serverCfg)
+
+	// withDialer connects to server, whatever the address,
+	// and records the address that was dialed.
+	withDialer := func(server *fakeSMTPServer, dialed *string) SendOption {
+		return func(o *sendOptions) {
+			o.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				*dialed = addr
+				var d net.Dialer
+				return d.DialContext(ctx, network, server.Addr())
+			}
+		}
+	}
+
+	for _, test := range []struct {
+		server      *fakeSMTPServer
+		opts        []SendOption
+		expected    string
+		description string
+	}{
+		{plain, nil, "mail.domain.com:25", "plain"},
+		{startTLS, []SendOption{WithRequireTLS()}, "mail.domain.com:587", "STARTTLS"},
+		{implicitTLS, []SendOption{WithImplicitTLS()}, "mail.domain.com:465", "implicit TLS"},
+	} {
+		var dialed string
+		opts := append(test.opts, withDialer(test.server, &dialed))
+
+		expectNoError(SendTLSMail("mail.domain.com", nil, testSendMessage(), clientCfg, opts...))
+		Expect(dialed).To(Equal(test.expected), test.description)
+
+		dialed = ""
+		expectNoError(NewSMTPSender("mail.domain.com", nil, clientCfg, opts...).SendMail(testSendMessage()))
+		Expect(dialed).To(Equal(test.expected), test.description)
+
+		dialed = ""
+		b, err := NewBatchSender("mail.domain.com", nil, clientCfg, opts...)
+		expectNoError(err)
+		expectNoError(b.Send(testSendMessage()))
+		expectNoError(b.Close())
+		Expect(dialed).To(Equal(test.expected), test.description)
+	}
+
+	Expect(plain.Messages()).To(HaveLen(3))
+	Expect(startTLS.Messages()).To(HaveLen(3))
+	Expect(startTLS.Count("STARTTLS")).To(Equal(3))
+	Expect(implicitTLS.Messages()).To(HaveLen(3))
+}
+
+func TestSendMailImplicitTLS(t *testing.T) {
+	registerFailHandler(t)
+
+	serverCfg, clientCfg := newTestTLSConfigs(t)
+
+	server := newFakeImplicitTLSSMTPServer(t, serverCfg)
+
+	result, err := SendTLSMailResult(server.Addr(), nil, testSendMessage(), clientCfg, WithImplicitTLS(), WithRequireTLS())
+	expectNoError(err)
+	Expect(result.TLS).NotTo(BeNil(), "TLS state not reported")
+	Expect(server.Count("STARTTLS")).To(BeZero())
+	Expect(server.Messages()).To(HaveLen(1))
+
+	b, err := NewBatchSender(server.Addr(), nil, clientCfg, WithImplicitTLS())
+	expectNoError(err)
+	expectNoError(b.Send(testSendMessage()))
+	expectNoError(b.Close())
+	Expect(server.Messages()).To(HaveLen(2))
+}
+
+func TestSendMailStreamed(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t, "SIZE 1000000")
+
+	newMessage := func() *Message {
+		m := testSendMessage()
+		m.Boundary = "test-boundary"
+		m.Headers = mail.Header{
+			"Date":       []string{"Mon, 02 Jan 2006 15:04:05 +0000"},
+			"Message-Id": []string{"<test@domain.com>"},
+		}
+		m.Attachments = []Attachment{{
+			Name: "test.txt",
+			Data: strings.NewReader(strings.Repeat("Test attachment\n", 10000)),
+		}}
+		return m
+	}
+
+	expected, err := newMessage().Bytes()
+	expectNoError(err)
+
+	expectNoError(SendMail(server.Addr(), nil, newMessage()))
+
+	// The size of a streamed message isn't known up front.
+	cmd, ok := server.Command("MAIL")
+	Expect(ok).To(BeTrue(), "MAIL command not sent")
+	Expect(cmd).To(Equal("MAIL FROM:<sender@domain.com>"))
+
+	messages := server.Messages()
+	Expect(messages).To(HaveLen(1))
+	Expect(messages[0]).To(Equal(strings.Replace(string(expected), "\r\n", "\n", -1)))
+}
+
+func TestSendMailRecipientFunc(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t)
+	server.reply = func(cmd string) string {
+		if cmd == "RCPT TO:<to_2@domain.com>" {
+			return "550 5.1.1 No such user"
+		}
+		return ""
+	}
+
+	type response struct {
+		address string
+		code    int
+		msg     string
+	}
+	var responses []response
+	onRecipient := func(address string, code int, msg string) {
+		responses = append(responses, response{address, code, msg})
+	}
+
+	m := testSendMessage()
+	m.AddTo("to_2@domain.com", "to_3@domain.com")
+
+	// The callback only reports: a rejected recipient still fails the send.
+	Expect(SendTLSMail(server.Addr(), nil, m, nil, WithRecipientFunc(onRecipient))).To(HaveOccurred())
+
+	Expect(responses).To(Equal([]response{
+		{"to_1@domain.com", 250, "OK"},
+		{"to_2@domain.com", 550, "5.1.1 No such user"},
+		{"to_3@domain.com", 250, "OK"},
+	}))
+	Expect(server.Messages()).To(BeEmpty())
+
+	// Without the callback, the send stops at the rejected recipient:
+	// three RCPTs for the first send, and two for this one.
+	Expect(SendMail(server.Addr(), nil, m)).To(HaveOccurred())
+	Expect(server.Count("RCPT")).To(Equal(5))
+	Expect(server.Messages()).To(BeEmpty())
+}
+
+func TestSendMailPartialSuccess(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t)
+	server.reply = func(cmd string) string {
+		if cmd == "RCPT TO:<to_2@domain.com>" {
+			return "550 5.1.1 No such user"
+		}
+		return ""
+	}
+
+	var rejected []string
+	onRecipient := func(address string, code int, msg string) {
+		if code != 250 {
+			rejected = append(rejected, address)
+		}
+	}
+
+	m := testSendMessage()
+	m.AddTo("to_2@domain.com", "to_3@domain.com")
+
+	expectNoError(SendTLSMail(server.Addr(), nil, m, nil, WithPartialSuccess(), WithRecipientFunc(onRecipient)))
+	Expect(rejected).To(Equal([]string{"to_2@domain.com"}))
+	Expect(server.Messages()).To(HaveLen(1))
+
+	expectNoError(SendTLSMail(server.Addr(), nil, m, nil, WithPartialSuccess()))
+	Expect(server.Messages()).To(HaveLen(2))
+
+	// The send only fails if all recipients are rejected.
+	m = testSendMessage()
+	m.To = nil
+	m.AddTo("to_2@domain.com")
+	Expect(SendTLSMail(server.Addr(), nil, m, nil, WithPartialSuccess())).To(HaveOccurred())
+	Expect(server.Messages()).To(HaveLen(2))
+}
+
+func TestSendMailEnvelopeFrom(t *testing.T) {
+	registerFailHandler(t)
+
+	server := newFakeSMTPServer(t)
+
+	m := testSendMessage()
+	m.SetFrom("User <user@theirdomain.com>")
+	m.EnvelopeFrom = "bounce@myservice.com"
+
+	expectNoError(SendMail(server.Addr(), nil, m))
+
+	cmd, ok := server.Command("MAIL")
+	Expect(ok).To(BeTrue(), "MAIL command not sent")
+	Expect(cmd).To(Equal("MAIL FROM:<bounce@myservice.com>"))
+
+	messages := server.Messages()
+	Expect(messages).To(HaveLen(1))
+	msg, err := mail.ReadMessage(strings.NewReader(messages[0]))
+	expectNoError(err)
+	Expect(msg.Header.Get("From")).To(Equal(`"User" <user@theirdomain.com>`))
+	Expect(msg.Header).NotTo(HaveKey("Return-Path"))
+
+	m.ReturnPathHeader = true
+	expectNoError(SendMail(server.Addr(), nil, m))
+
+	messages = server.Messages()
+	Expect(messages).To(HaveLen(2))
+	msg, err = mail.ReadMessage(strings.NewReader(messages[1]))
+	expectNoError(err)
+	Expect(msg.Header.Get("Return-Path")).To(Equal("<bounce@myservice.com>"))
+}
@@ -0,0 +1,274 @@
+package gophermail
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+)
+
+// A HeaderInjectionError is returned when a header name or value,
+// including any address field, contains a CR or LF character.
+type HeaderInjectionError struct {
+	Header string
+}
+
+func (e *HeaderInjectionError) Error() string {
+	return fmt.Sprintf("Header %q contains a newline.", e.Header)
+}
+
+// A TooManyRecipientsError is returned when a message has more
+// recipients than its MaxRecipients allows.
+type TooManyRecipientsError struct {
+	Count int
+	Max   int
+}
+
+func (e *TooManyRecipientsError) Error() string {
+	return fmt.Sprintf("%d recipients exceed the limit of %d.", e.Count, e.Max)
+}
+
+// Validate checks the message for problems that would prevent it
+// from being sent and returns the first one found.
+// Use ValidateAll to get every problem at once.
+func (m *Message) Validate() error {
+	errs := m.ValidateAll()
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// ValidateAll checks the message for problems that would prevent it
+// from being sent and returns all of them. It returns nil if the
+// message is valid.
+func (m *Message) ValidateAll() []error {
+	var errs []error
+
+	var emptyAddress mail.Address
+	if m.from() == emptyAddress {
+		errs = append(errs, ErrMissingFromAddress)
+	}
+
+	if m.recipientCount() == 0 || m.missingResentRecipient() {
+		errs = append(errs, ErrMissingRecipient)
+	}
+
+	if err := m.checkRecipientLimit(); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, groups := range [][]AddressGroup{m.ToGroups, m.CcGroups} {
+		for _, group := range groups {
+			if group.Name == "" {
+				errs = append(errs, ErrEmptyGroupName)
+			}
+		}
+	}
+
+	errs = append(errs, m.headerInjectionErrors()...)
+
+	if m.Boundary != "" {
+		if err := validateBoundary(m.Boundary); err != nil {
+			errs = append(errs, err)
+		}
+	} else if err := validateBoundaryPrefix(m.BoundaryPrefix); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := validateCalendarMethod(m.CalendarMethod); err != nil {
+		errs = append(errs, err)
+	}
+
+	if _, err := m.charset(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := m.validateMessageIDDomain(); err != nil {
+		errs = append(errs, err)
+	}
+
+	for i, attachment := range m.Attachments {
+		if attachment.Name == "" {
+			errs = append(errs, fmt.Errorf("Attachment %d has no name.", i))
+		}
+		if attachment.Data == nil {
+			errs = append(errs, fmt.Errorf("Attachment %d (%q) has no data.", i, attachment.Name))
+		}
+	}
+
+	if len(m.InlineImages) > 0 && m.HTMLBody == "" {
+		errs = append(errs, ErrInlineImagesWithoutHTMLBody)
+	}
+	for i, image := range m.InlineImages {
+		if image.Name == "" {
+			errs = append(errs, fmt.Errorf("Inline image %d has no name.", i))
+		}
+		if image.Data == nil {
+			errs = append(errs, fmt.Errorf("Inline image %d (%q) has no data.", i, image.Name))
+		}
+	}
+
+	return errs
+}
+
+// checkRecipientLimit returns a TooManyRecipientsError if the message
+// has more recipients than MaxRecipients.
+func (m *Message) checkRecipientLimit() error {
+	count := m.recipientCount()
+	if m.MaxRecipients > 0 && count > m.MaxRecipients {
+		return &TooManyRecipientsError{Count: count, Max: m.MaxRecipients}
+	}
+	return nil
+}
+
+// recipientCount returns the number of To, Cc and Bcc recipients,
+// including group members. Empty groups don't count.
+func (m *Message) recipientCount() int {
+	return len(m.To) + len(m.Cc) + len(m.Bcc) +
+		len(groupAddresses(m.ToGroups)) + len(groupAddresses(m.CcGroups))
+}
+
+// missingResentRecipient reports whether the message is resent
+// without anyone to send it to.
+func (m *Message) missingResentRecipient() bool {
+	return m.isResent() && len(m.ResentTo) == 0
+}
+
+// headerInjectionErrors returns a HeaderInjectionError for every
+// user-supplied header name or value that contains a CR or LF.
+func (m *Message) headerInjectionErrors() []error {
+	var errs []error
+
+	check := func(header string, values ...string) {
+		for _, v := range values {
+			if strings.ContainsAny(v, "\r\n") {
+				errs = append(errs, &HeaderInjectionError{Header: header})
+				return
+			}
+		}
+	}
+	checkAddresses := func(header string, addresses ...mail.Address) {
+		for _, address := range addresses {
+			check(header, address.Name, address.Address)
+		}
+	}
+
+	checkAddresses("From", m.from())
+	checkAddresses("Reply-To", m.ReplyTo)
+	checkAddresses("To", m.To...)
+	checkAddresses("Cc", m.Cc...)
+	for _, group := range m.ToGroups {
+		check("To", group.Name)
+		checkAddresses("To", group.Addresses...)
+	}
+	for _, group := range m.CcGroups {
+		check("Cc", group.Name)
+		checkAddresses("Cc", group.Addresses...)
+	}
+	checkAddresses("Bcc", m.Bcc...)
+	checkAddresses("Resent-From", m.ResentFrom)
+	checkAddresses("Resent-To", m.ResentTo...)
+	check("Subject", m.Subject)
+	check("Return-Path", m.EnvelopeFrom)
+	check("Message-ID", m.MessageIDDomain)
+	check("Content-Type", m.Boundary, m.BoundaryPrefix)
+
+	for k, vs := range m.Headers {
+		check(k, k)
+		check(k, vs...)
+	}
+
+	for _, attachment := range m.Attachments {
+		check("Content-Disposition", attachment.Name)
+		check("Content-Type", attachment.ContentType)
+	}
+	for _, image := range m.InlineImages {
+		check("Content-Id", image.Name)
+		check("Content-Type", image.ContentType)
+	}
+
+	if m.DKIM != nil {
+		check("DKIM-Signature", m.DKIM.Domain, m.DKIM.Selector)
+		check("DKIM-Signature", m.DKIM.Headers...)
+	}
+
+	return errs
+}
+
+// A DomainResolver looks up the DNS records used by
+// ValidateRecipientDomains. *net.Resolver implements it.
+type DomainResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// A NoMailExchangerError is returned by ValidateRecipientDomains
+// for a recipient domain that can't receive mail.
+type NoMailExchangerError struct {
+	Domain string
+
+	// Err is the error of the last lookup, if any.
+	Err error
+}
+
+func (e *NoMailExchangerError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Domain %q has no mail exchanger: %v", e.Domain, e.Err)
+	}
+	return fmt.Sprintf("Domain %q has no mail exchanger.", e.Domain)
+}
+
+// ValidateRecipientDomains checks that the domain of every To, Cc and Bcc
+// recipient has an MX record, or an address record as a fallback,
+// to catch mistyped domains before sending. It returns a
+// NoMailExchangerError for each domain that fails.
+//
+// This makes DNS queries, so it isn't part of Validate.
+// If r is nil, net.DefaultResolver is used.
+func (m *Message) ValidateRecipientDomains(ctx context.Context, r DomainResolver) []error {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	var errs []error
+	checked := map[string]bool{}
+
+	var recipients []mail.Address
+	recipients = append(recipients, m.To...)
+	recipients = append(recipients, m.Cc...)
+	recipients = append(recipients, groupAddresses(m.ToGroups)...)
+	recipients = append(recipients, groupAddresses(m.CcGroups)...)
+	recipients = append(recipients, m.Bcc...)
+
+	for _, recipient := range recipients {
+		domain := strings.ToLower(addressDomain(recipient.Address))
+		if checked[domain] {
+			continue
+		}
+		checked[domain] = true
+
+		if domain == "" {
+			errs = append(errs, &NoMailExchangerError{Domain: domain})
+			continue
+		}
+
+		mxs, err := r.LookupMX(ctx, domain)
+		if err == nil && len(mxs) > 0 {
+			// A single "." record is a null MX (RFC 7505),
+			// meaning the domain doesn't accept mail.
+			if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+				errs = append(errs, &NoMailExchangerError{Domain: domain})
+			}
+			continue
+		}
+
+		hosts, err := r.LookupHost(ctx, domain)
+		if err != nil || len(hosts) == 0 {
+			errs = append(errs, &NoMailExchangerError{Domain: domain, Err: err})
+		}
+	}
+
+	return errs
+}
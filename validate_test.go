@@ -0,0 +1,195 @@
+package gophermail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestValidate(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	expectNoError(m.SetFrom("Doman Sender <sender@domain.com>"))
+	expectNoError(m.AddTo("First person <to_1@domain.com>"))
+	m.Body = "Test message"
+	m.Attachments = []Attachment{{
+		Name: "test.txt",
+		Data: strings.NewReader("Test attachment"),
+	}}
+
+	Expect(m.ValidateAll()).To(BeEmpty())
+	expectNoError(m.Validate())
+}
+
+func TestValidateAll(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	m.Subject = "Hi\r\nBcc: attacker@evil.com"
+	m.Headers = mail.Header{}
+	m.Headers["X-Custom"] = []string{"value\nX-Injected: yes"}
+	m.Attachments = []Attachment{{
+		Name: "test.txt",
+	}}
+
+	errs := m.ValidateAll()
+	t.Logf("%v", errs)
+
+	Expect(errs).To(HaveLen(5))
+	Expect(errs).To(ContainElement(ErrMissingFromAddress))
+	Expect(errs).To(ContainElement(ErrMissingRecipient))
+	Expect(errs).To(ContainElement(&HeaderInjectionError{Header: "Subject"}))
+	Expect(errs).To(ContainElement(&HeaderInjectionError{Header: "X-Custom"}))
+	Expect(errs[4].Error()).To(ContainSubstring("has no data"))
+
+	Expect(m.Validate()).To(Equal(errs[0]))
+}
+
+func TestBytesHeaderInjection(t *testing.T) {
+	registerFailHandler(t)
+
+	for _, test := range []struct {
+		configure func(m *Message)
+		header    string
+	}{
+		{func(m *Message) { m.Subject = "Hi\r\nBcc: attacker@evil.com" }, "Subject"},
+		{func(m *Message) { m.Headers = mail.Header{"X-Custom\r\nBcc": []string{"attacker@evil.com"}} }, "X-Custom\r\nBcc"},
+		{func(m *Message) { m.Headers = mail.Header{"X-Custom": []string{"value\n\nFake body"}} }, "X-Custom"},
+		{func(m *Message) { m.To[0].Name = "First\rperson" }, "To"},
+		{func(m *Message) { m.From.Address = "sender@domain.com\nBcc: attacker@evil.com" }, "From"},
+		{func(m *Message) { m.ReplyTo.Name = "Reply\r\nBcc: attacker@evil.com" }, "Reply-To"},
+		{func(m *Message) { m.AddCcGroup("Team\r\nBcc: attacker@evil.com", "cc_1@domain.com") }, "Cc"},
+		{func(m *Message) {
+			m.ResentFrom.Address = "resender@domain.com\r\nBcc: attacker@evil.com"
+			m.ResentTo = m.To
+		}, "Resent-From"},
+		{func(m *Message) {
+			m.EnvelopeFrom = "bounces@domain.com>\r\nBcc: attacker@evil.com"
+			m.ReturnPathHeader = true
+		}, "Return-Path"},
+		{func(m *Message) { m.MessageIDDomain = "d.com>\r\nBcc: evil@evil.com\r\nX-A: <" }, "Message-ID"},
+		{func(m *Message) { m.BoundaryPrefix = "prefix\r\nBcc: attacker@evil.com" }, "Content-Type"},
+		{func(m *Message) { m.Boundary = "golden\r\nBcc: attacker@evil.com" }, "Content-Type"},
+		{func(m *Message) {
+			m.Attachments = []Attachment{{Name: "test.txt\r\nX-Evil: 1", Data: strings.NewReader("Test attachment")}}
+		}, "Content-Disposition"},
+		{func(m *Message) {
+			m.Attachments = []Attachment{{Name: "test.txt", ContentType: "text/plain\r\nX-Evil: 1", Data: strings.NewReader("Test attachment")}}
+		}, "Content-Type"},
+		{func(m *Message) {
+			m.HTMLBody = `<img src="cid:logo.png">`
+			m.InlineImages = []Attachment{{Name: "logo.png\r\nX-Evil: 1", Data: strings.NewReader("image")}}
+		}, "Content-Id"},
+		{func(m *Message) {
+			m.HTMLBody = `<img src="cid:logo.png">`
+			m.InlineImages = []Attachment{{Name: "logo.png", ContentType: "image/png\r\nX-Evil: 1", Data: strings.NewReader("image")}}
+		}, "Content-Type"},
+		{func(m *Message) {
+			m.DKIM = &DKIMOptions{Selector: "default", Domain: "domain.com\r\nX-Evil: 1"}
+		}, "DKIM-Signature"},
+	} {
+		m := &Message{}
+		expectNoError(m.SetFrom("Doman Sender <sender@domain.com>"))
+		expectNoError(m.AddTo("First person <to_1@domain.com>"))
+		m.Body = "Test message"
+		test.configure(m)
+
+		_, err := m.Bytes()
+		Expect(err).To(Equal(&HeaderInjectionError{Header: test.header}))
+		Expect(err.Error()).To(Equal(fmt.Sprintf("Header %q contains a newline.", test.header)))
+
+		Expect(m.Validate()).To(Equal(err))
+
+		var buffer bytes.Buffer
+		_, err = m.WriteTo(&buffer)
+		Expect(err).To(Equal(&HeaderInjectionError{Header: test.header}))
+		Expect(buffer.Len()).To(BeZero(), "message written despite the error")
+	}
+
+	// The package's own folding of long encoded subjects is fine.
+	m := &Message{}
+	expectNoError(m.SetFrom("Doman Sender <sender@domain.com>"))
+	expectNoError(m.AddTo("First person <to_1@domain.com>", "Second person <to_2@domain.com>"))
+	m.Subject = strings.Repeat("Árvíztűrő tükörfúrógép ", 10)
+	m.Body = "Test message"
+	_, err := m.Bytes()
+	expectNoError(err)
+}
+
+func TestMaxRecipients(t *testing.T) {
+	registerFailHandler(t)
+
+	m := &Message{}
+	expectNoError(m.SetFrom("Doman Sender <sender@domain.com>"))
+	expectNoError(m.AddTo("to_1@domain.com", "to_2@domain.com"))
+	expectNoError(m.AddCc("cc_1@domain.com"))
+	m.Body = "Test message"
+	m.MaxRecipients = 3
+
+	expectNoError(m.Validate())
+	_, err := m.Bytes()
+	expectNoError(err)
+
+	expectNoError(m.AddBcc("bcc_1@domain.com"))
+
+	expected := &TooManyRecipientsError{Count: 4, Max: 3}
+	Expect(m.Validate()).To(Equal(expected))
+	_, err = m.Bytes()
+	Expect(err).To(Equal(expected))
+	Expect(err.Error()).To(Equal("4 recipients exceed the limit of 3."))
+}
+
+// fakeResolver is a DomainResolver with fixed records.
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mxs, ok := r.mx[name]; ok {
+		return mxs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name}
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if hosts, ok := r.hosts[host]; ok {
+		return hosts, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host}
+}
+
+func TestValidateRecipientDomains(t *testing.T) {
+	registerFailHandler(t)
+
+	resolver := &fakeResolver{
+		mx: map[string][]*net.MX{
+			"domain.com": {{Host: "mx.domain.com.", Pref: 10}},
+			"nomail.com": {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{
+			"a-only.com": {"192.0.2.1"},
+		},
+	}
+
+	m := &Message{}
+	expectNoError(m.SetFrom("Doman Sender <sender@domain.com>"))
+	expectNoError(m.AddTo("to_1@domain.com", "to_2@Domain.com", "to_3@a-only.com"))
+	expectNoError(m.AddCc("cc_1@domian.com"))
+	expectNoError(m.AddBcc("bcc_1@nomail.com"))
+
+	errs := m.ValidateRecipientDomains(context.Background(), resolver)
+	t.Logf("%v", errs)
+
+	Expect(errs).To(HaveLen(2))
+	Expect(errs[0].(*NoMailExchangerError).Domain).To(Equal("domian.com"))
+	Expect(errs[0].(*NoMailExchangerError).Err).NotTo(BeNil())
+	Expect(errs[1]).To(Equal(&NoMailExchangerError{Domain: "nomail.com"}))
+}